@@ -1,17 +1,21 @@
 package main
 
 import (
+	"context"
 	"math/rand"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/rwlist/coub/pkg/coubs"
 	"github.com/rwlist/coub/pkg/local"
+	"github.com/rwlist/coub/pkg/metrics"
+	"github.com/rwlist/coub/pkg/retry"
+	"github.com/rwlist/coub/pkg/storage"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/davecgh/go-spew/spew"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -25,6 +29,8 @@ import (
 func main() {
 	rand.Seed(time.Now().UnixNano())
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetReportCaller(true)
 	log.SetLevel(log.DebugLevel)
@@ -34,15 +40,52 @@ func main() {
 		log.WithError(err).Fatal("failed to parse config from env")
 	}
 
-	go func() {
-		mux := http.NewServeMux()
-		mux.Handle("/metrics", promhttp.Handler())
-		err := http.ListenAndServe(cfg.PrometheusBind, mux) //nolint:govet
-		if err != nil && err != http.ErrServerClosed {
-			log.WithError(err).Fatal("prometheus server error")
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	metricsServer := newHTTPServer(cfg.PrometheusBind, mux)
+	listen(metricsServer, "prometheus")
+
+	db, cookies := openDB(cfg)
+
+	store, err := storage.New(cfg)
+	if err != nil {
+		log.WithError(err).Fatal("failed to create storage")
+	}
+
+	tracker := local.NewTracker(cfg.JobHistorySize)
+	cli := newClient(cfg, cookies)
+	downloader := local.NewDownloader(cli, store, db, cfg)
+	backup := local.NewBackup(downloader, cli, db, tracker, cfg)
+
+	var schedules []local.Schedule
+	if cfg.EnableBackup {
+		schedules, err = local.Schedules(cfg)
+		if err != nil {
+			log.WithError(err).Fatal("invalid backup config")
 		}
-	}()
+	}
+	scheduler := local.NewScheduler(backup, schedules)
+	backups := startBackups(ctx, cfg, scheduler, downloader)
+
+	metrics.SessionAge(cookies.LastRefreshed)
+	if cfg.StorageCountInterval > 0 {
+		go metrics.CountObjectsLoop(ctx, store, cfg.StorageCountInterval)
+	}
+
+	health := local.NewHealth(db, store, cli, cfg.SessionCheckInterval)
+	server := local.NewServer(store, db, cfg, tracker, downloader, scheduler, health)
+	httpServer := newHTTPServer(cfg.BindHTTP, server.Router())
+	httpServer.RegisterOnShutdown(server.Close)
+	listen(httpServer, "http")
+
+	<-ctx.Done()
+	// restore default signal handling, so the second signal kills the process
+	stop()
+	shutdown(cfg, httpServer, metricsServer, backups)
+}
 
+// openDB connects to postgres and migrates all tables.
+func openDB(cfg *conf.App) (*gorm.DB, *coubs.Cookies) {
 	db, err := gorm.Open(postgres.Open(cfg.PostgresDSN), &gorm.Config{})
 	if err != nil {
 		log.WithError(err).Fatal("failed to connect to postgres")
@@ -63,44 +106,95 @@ func main() {
 	c, err := cookies.Get()
 	spew.Dump(c, err)
 
-	// Configure to use MinIO Server
-	s3Config := &aws.Config{
-		Credentials:      credentials.NewStaticCredentials(cfg.S3AccessKey, cfg.S3SecretKey, ""),
-		Endpoint:         aws.String(cfg.S3Endpoint),
-		Region:           aws.String(cfg.S3Region),
-		DisableSSL:       aws.Bool(false),
-		S3ForcePathStyle: aws.Bool(true),
-	}
-	newSession, err := session.NewSession(s3Config)
-	if err != nil {
-		log.WithError(err).Fatal("failed to create new session")
+	return db, cookies
+}
+
+func newClient(cfg *conf.App, cookies *coubs.Cookies) *coubs.Client {
+	return coubs.NewClient(
+		cookies,
+		coubs.WithBaseURL(cfg.CoubAPIURL),
+		coubs.WithTimeout(cfg.CoubTimeout),
+		coubs.WithRateLimit(cfg.CoubRateLimit),
+		coubs.WithRetry(retry.Policy{
+			MaxAttempts: cfg.RetryAttempts,
+			BaseDelay:   cfg.RetryBaseDelay,
+			MaxDelay:    cfg.RetryMaxDelay,
+		}),
+	)
+}
+
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
 	}
+}
 
-	s3Client := s3.New(newSession)
+// listen serves in background until the server is shut down.
+func listen(server *http.Server, name string) {
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Fatal(name + " server error")
+		}
+	}()
+}
 
-	state := local.NewSharedState()
-	cli := coubs.NewClient(cookies)
-	downloader := local.NewDownloader(cli, s3Client, db, cfg)
-	backup := local.NewBackup(downloader, cli, db, state)
+// startBackups runs scheduled backups and, if backups are enabled, retries
+// of failed downloads until ctx is done. The returned group is done when
+// they all have stopped.
+func startBackups(ctx context.Context, cfg *conf.App, scheduler *local.Scheduler, downloader *local.Downloader) *sync.WaitGroup {
+	var backups sync.WaitGroup
+	backups.Add(1)
+	go func() {
+		defer backups.Done()
+		scheduler.Run(ctx)
+	}()
 
 	if cfg.EnableBackup {
+		backups.Add(1)
 		go func() {
-			usernames := cfg.BackupProfiles
-
-			for _, username := range usernames {
-				log.WithField("username", username).Info("backup started")
-				err = backup.Profile(username)
-				if err != nil {
-					log.WithError(err).Fatal("failed to download profile")
-				}
-			}
+			defer backups.Done()
+			downloader.RetryFailedLoop(ctx, cfg.FailedRetryInterval)
 		}()
 	}
+	return &backups
+}
+
+// shutdown stops accepting requests, waits for backups to save started
+// downloads and checkpoints, then stops the metrics server.
+func shutdown(cfg *conf.App, httpServer, metricsServer *http.Server, backups *sync.WaitGroup) {
+	log.WithField("timeout", cfg.ShutdownTimeout).Info("shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	err := httpServer.Shutdown(shutdownCtx)
+	if err != nil {
+		log.WithError(err).Error("failed to shutdown http server")
+	}
+
+	// backups finish started downloads within cfg.ShutdownTimeout, but
+	// a stuck database call must not hang the shutdown
+	log.Info("waiting for backups to stop")
+	stopped := make(chan struct{})
+	go func() {
+		backups.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		log.Warn("backups didn't stop within the shutdown timeout")
+	}
 
-	server := local.NewServer(s3Client, db, cfg, state)
-	r := server.Router()
-	err = http.ListenAndServe(cfg.BindHTTP, r)
+	// the deadline may be already spent on backups, metrics are scraped quickly
+	metricsCtx, cancelMetrics := context.WithTimeout(context.Background(), time.Second)
+	defer cancelMetrics()
+	err = metricsServer.Shutdown(metricsCtx)
 	if err != nil {
-		log.WithError(err).Fatal("http server error")
+		log.WithError(err).Error("failed to shutdown prometheus server")
 	}
+	log.Info("shutdown complete")
 }
@@ -1,21 +1,56 @@
 package conf
 
 import (
+	"time"
+
 	"github.com/caarlos0/env/v6"
 )
 
 type App struct {
-	PrometheusBind string   `env:"PROMETHEUS_BIND" envDefault:":2112"`
-	PostgresDSN    string   `env:"PG_DSN"`
-	S3Endpoint     string   `env:"S3_ENDPOINT"`
-	S3Region       string   `env:"S3_REGION"`
-	S3AccessKey    string   `env:"S3_ACCESS_KEY_ID"`
-	S3SecretKey    string   `env:"S3_SECRET_ACCESS_KEY"`
-	S3Bucket       string   `env:"S3_BUCKET"`
-	CoubUsername   string   `env:"COUB_USERNAME"`
-	BindHTTP       string   `env:"BIND_HTTP" envDefault:":8080"`
-	EnableBackup   bool     `env:"ENABLE_BACKUP" envDefault:"false"`
-	BackupProfiles []string `env:"BACKUP_PROFILES" envSeparator:","`
+	PrometheusBind       string        `env:"PROMETHEUS_BIND" envDefault:":2112"`
+	PostgresDSN          string        `env:"PG_DSN"`
+	S3Endpoint           string        `env:"S3_ENDPOINT"`
+	S3Region             string        `env:"S3_REGION"`
+	S3AccessKey          string        `env:"S3_ACCESS_KEY_ID"`
+	S3SecretKey          string        `env:"S3_SECRET_ACCESS_KEY"`
+	S3Bucket             string        `env:"S3_BUCKET"`
+	CoubUsername         string        `env:"COUB_USERNAME"`
+	CoubAPIURL           string        `env:"COUB_API_URL" envDefault:"https://coub.com/api/v2"`
+	CoubTimeout          time.Duration `env:"COUB_TIMEOUT" envDefault:"30s"`
+	CoubRateLimit        float64       `env:"COUB_RATE_LIMIT" envDefault:"2"`
+	RetryAttempts        int           `env:"RETRY_ATTEMPTS" envDefault:"5"`
+	RetryBaseDelay       time.Duration `env:"RETRY_BASE_DELAY" envDefault:"1s"`
+	RetryMaxDelay        time.Duration `env:"RETRY_MAX_DELAY" envDefault:"1m"`
+	BindHTTP             string        `env:"BIND_HTTP" envDefault:":8080"`
+	EnableBackup         bool          `env:"ENABLE_BACKUP" envDefault:"false"`
+	BackupProfiles       []string      `env:"BACKUP_PROFILES" envSeparator:","`
+	BackupLikes          bool          `env:"BACKUP_LIKES" envDefault:"false"`
+	BackupFavorites      bool          `env:"BACKUP_FAVORITES" envDefault:"false"`
+	BackupTimelines      []string      `env:"BACKUP_TIMELINES" envSeparator:","`
+	UploadPartSize       int64         `env:"UPLOAD_PART_SIZE" envDefault:"5242880"`
+	UploadConcurrency    int           `env:"UPLOAD_CONCURRENCY" envDefault:"1"`
+	StorageBackend       string        `env:"STORAGE_BACKEND" envDefault:"s3"`
+	StorageDir           string        `env:"STORAGE_DIR" envDefault:"data"`
+	DownloadWorkers      int           `env:"DOWNLOAD_WORKERS" envDefault:"1"`
+	FailedRetryInterval  time.Duration `env:"FAILED_RETRY_INTERVAL" envDefault:"15m"`
+	FailedRetryDelay     time.Duration `env:"FAILED_RETRY_DELAY" envDefault:"10m"`
+	FailedMaxAttempts    int           `env:"FAILED_MAX_ATTEMPTS" envDefault:"10"`
+	BackupRescan         bool          `env:"BACKUP_RESCAN" envDefault:"false"`
+	BackupMode           string        `env:"BACKUP_MODE" envDefault:"full"`
+	IncrementalStopAfter int           `env:"INCREMENTAL_STOP_AFTER" envDefault:"20"`
+	BackupInterval       time.Duration `env:"BACKUP_INTERVAL" envDefault:"0"`
+	BackupIntervals      []string      `env:"BACKUP_INTERVALS" envSeparator:","`
+	BackupFullInterval   time.Duration `env:"BACKUP_FULL_INTERVAL" envDefault:"168h"`
+	VerifyUpstream       bool          `env:"VERIFY_UPSTREAM" envDefault:"false"`
+	VerifyInterval       time.Duration `env:"VERIFY_INTERVAL" envDefault:"168h"`
+	RefreshMetadata      bool          `env:"REFRESH_METADATA" envDefault:"false"`
+	RefreshInterval      time.Duration `env:"REFRESH_INTERVAL" envDefault:"24h"`
+	JobHistorySize       int           `env:"JOB_HISTORY_SIZE" envDefault:"50"`
+	StorageCountInterval time.Duration `env:"STORAGE_COUNT_INTERVAL" envDefault:"1h"`
+	SessionCheckInterval time.Duration `env:"SESSION_CHECK_INTERVAL" envDefault:"5m"`
+	ShutdownTimeout      time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"8s"`
+	DownloadRateLimit    float64       `env:"DOWNLOAD_RATE_LIMIT" envDefault:"2"`
+	DownloadTimeout      time.Duration `env:"DOWNLOAD_TIMEOUT" envDefault:"5m"`
 }
 
 func ParseEnv() (*App, error) {
@@ -1,56 +1,201 @@
 package coubs
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rwlist/coub/pkg/metrics"
+	"github.com/rwlist/coub/pkg/retry"
 )
 
-type Client struct {
-	cookies *Cookies
+const DefaultBaseURL = "https://coub.com/api/v2"
+
+type Option func(*Client)
+
+// WithBaseURL points the client at a different Coub API root, e.g. a mirror,
+// a recording proxy or an httptest server.
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) {
+		c.baseURL = strings.TrimRight(baseURL, "/")
+	}
 }
 
-func NewClient(cookies *Cookies) *Client {
-	return &Client{
-		cookies: cookies,
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
 	}
 }
 
-func (c *Client) ChannelTimeline(name string, page int) (*PageResponse, error) {
-	st, err := c.cookies.Get()
-	if err != nil {
-		return nil, err
+func WithTransport(transport http.RoundTripper) Option {
+	return func(c *Client) {
+		c.transport = transport
 	}
-	req := st.Request
+}
 
-	requestURL, err := url.Parse(
-		fmt.Sprintf("https://coub.com/api/v2/timeline/channel/%s?order_by=newest&permalink=%s&type=&page=%d",
-			name, name, page,
-		))
-	if err != nil {
-		return nil, err
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
 	}
+}
 
-	req.Method = http.MethodGet
-	req.URL = requestURL
-	req.RequestURI = ""
-	req.Header.Del("Accept-Encoding")
+// WithRetry enables retries of failed requests, see APIError.Temporary.
+func WithRetry(policy retry.Policy) Option {
+	return func(c *Client) {
+		c.retry = policy
+	}
+}
+
+// WithRateLimit limits the rate of requests to the API, including retries.
+func WithRateLimit(perSecond float64) Option {
+	return func(c *Client) {
+		c.limiter = retry.NewLimiter(perSecond)
+	}
+}
+
+// Session provides request headers with cookies of the logged in account,
+// and keeps cookies updated by responses. Cookies stores it in the database.
+type Session interface {
+	Get() (*State, error)
+	Update(resp *http.Response) error
+}
+
+type Client struct {
+	cookies    Session
+	baseURL    string
+	httpClient *http.Client
+	transport  http.RoundTripper
+	timeout    time.Duration
+	retry      retry.Policy
+	limiter    *retry.Limiter
+}
 
-	resp, err := http.DefaultClient.Do(req)
+func NewClient(cookies Session, opts ...Option) *Client {
+	c := &Client{
+		cookies: cookies,
+		baseURL: DefaultBaseURL,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	// copy the client, so that transport and timeout options never modify
+	// the instance passed by the caller
+	httpClient := http.Client{}
+	if c.httpClient != nil {
+		httpClient = *c.httpClient
+	}
+	if c.transport != nil {
+		httpClient.Transport = c.transport
+	}
+	if c.timeout != 0 {
+		httpClient.Timeout = c.timeout
+	}
+	c.httpClient = &httpClient
+
+	return c
+}
+
+func (c *Client) ChannelTimeline(ctx context.Context, name string, page int) (*PageResponse, error) {
+	query := url.Values{}
+	query.Set("order_by", "newest")
+	query.Set("permalink", name)
+	query.Set("type", "")
+	query.Set("page", strconv.Itoa(page))
+
+	return c.timeline(ctx, "/timeline/channel/"+url.PathEscape(name), query)
+}
+
+func (c *Client) Likes(ctx context.Context, page int) (*PageResponse, error) {
+	query := url.Values{}
+	query.Set("all", "true")
+	query.Set("order_by", "date")
+	query.Set("page", strconv.Itoa(page))
+
+	return c.timeline(ctx, "/timeline/likes", query)
+}
+
+// Favorites returns coubs bookmarked by the account of the session.
+func (c *Client) Favorites(ctx context.Context, page int) (*PageResponse, error) {
+	query := url.Values{}
+	query.Set("all", "true")
+	query.Set("order_by", "date")
+	query.Set("page", strconv.Itoa(page))
+
+	return c.timeline(ctx, "/timeline/favourites", query)
+}
+
+func (c *Client) TagTimeline(ctx context.Context, tag string, page int) (*PageResponse, error) {
+	query := url.Values{}
+	query.Set("order_by", "newest")
+	query.Set("page", strconv.Itoa(page))
+
+	return c.timeline(ctx, "/timeline/tag/"+url.PathEscape(tag), query)
+}
+
+// Community timeline sections.
+const (
+	CommunityFresh   = "fresh"
+	CommunityRising  = "rising"
+	CommunityDaily   = "daily"
+	CommunityWeekly  = "weekly"
+	CommunityMonthly = "monthly"
+)
+
+func (c *Client) CommunityTimeline(ctx context.Context, community, section string, page int) (*PageResponse, error) {
+	query := url.Values{}
+	query.Set("page", strconv.Itoa(page))
+
+	return c.timeline(ctx, "/timeline/community/"+url.PathEscape(community)+"/"+url.PathEscape(section), query)
+}
+
+func (c *Client) HotTimeline(ctx context.Context, page int) (*PageResponse, error) {
+	query := url.Values{}
+	query.Set("page", strconv.Itoa(page))
+
+	return c.timeline(ctx, "/timeline/hot", query)
+}
+
+func (c *Client) FeaturedTimeline(ctx context.Context, page int) (*PageResponse, error) {
+	query := url.Values{}
+	query.Set("page", strconv.Itoa(page))
+
+	return c.timeline(ctx, "/timeline/featured", query)
+}
+
+func (c *Client) Search(ctx context.Context, text string, page int) (*PageResponse, error) {
+	query := url.Values{}
+	query.Set("q", text)
+	query.Set("order_by", "newest")
+	query.Set("page", strconv.Itoa(page))
+
+	return c.timeline(ctx, "/search/coubs", query)
+}
+
+// Coub fetches metadata of a single coub by its permalink or numeric ID.
+func (c *Client) Coub(ctx context.Context, permalink string) (json.RawMessage, error) {
+	body, err := c.get(ctx, "/coubs/"+url.PathEscape(permalink), url.Values{})
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	err = c.cookies.Update(req, resp)
+	var coub Coub
+	err = json.Unmarshal(body, &coub)
 	if err != nil {
 		return nil, err
 	}
 
-	var body []byte
-	body, err = io.ReadAll(resp.Body)
+	return body, nil
+}
+
+func (c *Client) timeline(ctx context.Context, path string, query url.Values) (*PageResponse, error) {
+	body, err := c.get(ctx, path, query)
 	if err != nil {
 		return nil, err
 	}
@@ -64,52 +209,83 @@ func (c *Client) ChannelTimeline(name string, page int) (*PageResponse, error) {
 	return &pageResponse, nil
 }
 
-func (c *Client) Likes(page int) (*PageResponse, error) {
-	// https://coub.com/api/v2/timeline/likes?all=true&order_by=date&page=1
+func (c *Client) get(ctx context.Context, path string, query url.Values) ([]byte, error) {
+	var body []byte
+	err := c.retry.Do(ctx, func() error {
+		var err error
+		body, err = c.do(ctx, path, query)
+
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && !apiErr.Temporary() {
+			return retry.Permanent(err)
+		}
+		return err
+	})
+	return body, err
+}
+
+func (c *Client) do(ctx context.Context, path string, query url.Values) ([]byte, error) {
+	err := c.limiter.Wait(ctx)
+	if err != nil {
+		return nil, retry.Permanent(err)
+	}
 
 	st, err := c.cookies.Get()
 	if err != nil {
 		return nil, err
 	}
-	req := st.Request
+	req := st.Request.WithContext(ctx)
 
-	requestURL, err := url.Parse(
-		fmt.Sprintf(
-			"https://coub.com/api/v2/timeline/likes?all=true&order_by=date&page=%d",
-			page,
-		),
-	)
+	requestURL, err := url.Parse(c.baseURL + path)
 	if err != nil {
 		return nil, err
 	}
+	requestURL.RawQuery = query.Encode()
 
 	req.Method = http.MethodGet
 	req.URL = requestURL
+	req.Host = requestURL.Host
 	req.RequestURI = ""
 	req.Header.Del("Accept-Encoding")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
+		metrics.APIRequests.WithLabelValues(endpointName(path), "error").Inc()
 		return nil, err
 	}
 	defer resp.Body.Close()
+	metrics.APIRequests.WithLabelValues(endpointName(path), strconv.Itoa(resp.StatusCode)).Inc()
 
-	err = c.cookies.Update(req, resp)
+	err = c.cookies.Update(resp)
 	if err != nil {
 		return nil, err
 	}
 
-	var body []byte
-	body, err = io.ReadAll(resp.Body)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	var pageResponse PageResponse
-	err = json.Unmarshal(body, &pageResponse)
-	if err != nil {
-		return nil, err
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, newAPIError(path, resp, body)
+	}
+	if !strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		return nil, newAPIError(path, resp, body)
 	}
 
-	return &pageResponse, nil
+	return body, nil
+}
+
+// endpointName strips user supplied parts from the API path, so that it can
+// be used as a metric label.
+func endpointName(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case parts[0] == "coubs":
+		return "coubs"
+	case len(parts) > 2:
+		return parts[0] + "/" + parts[1]
+	default:
+		return strings.Join(parts, "/")
+	}
 }
@@ -0,0 +1,273 @@
+package coubs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rwlist/coub/pkg/retry"
+)
+
+const testHeaders = "GET /api/v2/timeline HTTP/1.1\r\n" +
+	"Host: coub.com\r\n" +
+	"Cookie: remember_token=abc; session=1\r\n" +
+	"User-Agent: test"
+
+// memorySession keeps the session in memory, as Cookies does in the database.
+type memorySession struct {
+	mux     sync.Mutex
+	headers string
+}
+
+func (s *memorySession) Get() (*State, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return ParseState(s.headers)
+}
+
+func (s *memorySession) Update(resp *http.Response) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	st, err := ParseState(s.headers)
+	if err != nil {
+		return err
+	}
+	if st.MergeCookies(resp.Cookies(), time.Now()) {
+		s.headers = st.Headers()
+	}
+	return nil
+}
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) (*Client, *memorySession) {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	session := &memorySession{headers: testHeaders}
+	client := NewClient(session,
+		WithBaseURL(server.URL+"/api/v2/"),
+		WithTimeout(time.Second),
+		WithRetry(retry.Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}),
+	)
+	return client, session
+}
+
+func TestClientTimeline(t *testing.T) {
+	client, session := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/timeline/likes" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if page := r.URL.Query().Get("page"); page != "2" {
+			t.Errorf("unexpected page %q", page)
+		}
+		if cookie := r.Header.Get("Cookie"); cookie != "remember_token=abc; session=1" {
+			t.Errorf("unexpected cookie %q", cookie)
+		}
+		if r.Header.Get("User-Agent") != "test" {
+			t.Errorf("unexpected user agent %q", r.Header.Get("User-Agent"))
+		}
+
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "2"})
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_, _ = w.Write([]byte(`{"page":2,"per_page":1,"total_pages":3,"coubs":[{"id":42}]}`))
+	})
+
+	res, err := client.Likes(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Page != 2 || res.TotalPages != 3 || len(res.Coubs) != 1 {
+		t.Errorf("unexpected response %+v", res)
+	}
+
+	st, err := session.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookie := st.Request.Header.Get("Cookie"); cookie != "remember_token=abc; session=2" {
+		t.Errorf("session was not updated, cookie %q", cookie)
+	}
+}
+
+func TestClientTimelines(t *testing.T) {
+	tests := []struct {
+		name      string
+		fetch     func(ctx context.Context, c *Client) (*PageResponse, error)
+		wantPath  string
+		wantQuery url.Values
+	}{
+		{
+			name: "tag",
+			fetch: func(ctx context.Context, c *Client) (*PageResponse, error) {
+				return c.TagTimeline(ctx, "funny cats", 2)
+			},
+			wantPath:  "/api/v2/timeline/tag/funny%20cats",
+			wantQuery: url.Values{"order_by": {"newest"}, "page": {"2"}},
+		},
+		{
+			name: "community",
+			fetch: func(ctx context.Context, c *Client) (*PageResponse, error) {
+				return c.CommunityTimeline(ctx, "animals-pets", CommunityWeekly, 2)
+			},
+			wantPath:  "/api/v2/timeline/community/animals-pets/weekly",
+			wantQuery: url.Values{"page": {"2"}},
+		},
+		{
+			name: "hot",
+			fetch: func(ctx context.Context, c *Client) (*PageResponse, error) {
+				return c.HotTimeline(ctx, 2)
+			},
+			wantPath:  "/api/v2/timeline/hot",
+			wantQuery: url.Values{"page": {"2"}},
+		},
+		{
+			name: "featured",
+			fetch: func(ctx context.Context, c *Client) (*PageResponse, error) {
+				return c.FeaturedTimeline(ctx, 2)
+			},
+			wantPath:  "/api/v2/timeline/featured",
+			wantQuery: url.Values{"page": {"2"}},
+		},
+		{
+			name: "search",
+			fetch: func(ctx context.Context, c *Client) (*PageResponse, error) {
+				return c.Search(ctx, "cats & dogs", 2)
+			},
+			wantPath:  "/api/v2/search/coubs",
+			wantQuery: url.Values{"q": {"cats & dogs"}, "order_by": {"newest"}, "page": {"2"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if path := r.URL.EscapedPath(); path != tt.wantPath {
+					t.Errorf("path %s, want %s", path, tt.wantPath)
+				}
+				if query := r.URL.Query(); !reflect.DeepEqual(query, tt.wantQuery) {
+					t.Errorf("query %v, want %v", query, tt.wantQuery)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"page":2,"per_page":1,"total_pages":3,"coubs":[{"id":42}]}`))
+			})
+
+			res, err := tt.fetch(context.Background(), client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Page != 2 || res.TotalPages != 3 || len(res.Coubs) != 1 {
+				t.Errorf("unexpected response %+v", res)
+			}
+		})
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		contentType    string
+		retryAfter     string
+		wantErr        error
+		wantCalls      int
+		wantRetryAfter time.Duration
+	}{
+		{name: "not found", status: http.StatusNotFound, contentType: "application/json", wantErr: ErrNotFound, wantCalls: 1},
+		{name: "forbidden", status: http.StatusForbidden, contentType: "application/json", wantErr: ErrSessionExpired, wantCalls: 1},
+		{name: "unauthorized", status: http.StatusUnauthorized, contentType: "application/json", wantErr: ErrSessionExpired, wantCalls: 1},
+		{name: "rate limited", status: http.StatusTooManyRequests, contentType: "application/json", wantErr: ErrRateLimited, wantCalls: 3},
+		{
+			// waiting longer than MaxDelay is left to the caller
+			name:           "rate limited for long",
+			status:         http.StatusTooManyRequests,
+			contentType:    "application/json",
+			retryAfter:     "3600",
+			wantErr:        ErrRateLimited,
+			wantCalls:      1,
+			wantRetryAfter: time.Hour,
+		},
+		{name: "server error", status: http.StatusBadGateway, contentType: "text/html", wantCalls: 3},
+		{name: "not json", status: http.StatusOK, contentType: "text/html", wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			client, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte("<html>error</html>"))
+			})
+
+			_, err := client.ChannelTimeline(context.Background(), "name", 1)
+
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("expected APIError, got %v", err)
+			}
+			if apiErr.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", apiErr.StatusCode, tt.status)
+			}
+			if apiErr.RetryAfter() != tt.wantRetryAfter {
+				t.Errorf("retry after %v, want %v", apiErr.RetryAfter(), tt.wantRetryAfter)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("error %v is not %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("%d calls, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestClientRetrySucceeds(t *testing.T) {
+	calls := 0
+	client, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":1,"permalink":"abc"}`))
+	})
+
+	raw, err := client.Coub(context.Background(), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != `{"id":1,"permalink":"abc"}` {
+		t.Errorf("unexpected body %s", raw)
+	}
+	if calls != 2 {
+		t.Errorf("%d calls, want 2", calls)
+	}
+}
+
+func TestEndpointName(t *testing.T) {
+	tests := map[string]string{
+		"/timeline/channel/" + url.PathEscape("a/b"): "timeline/channel",
+		"/timeline/community/cats/fresh":             "timeline/community",
+		"/timeline/likes":                            "timeline/likes",
+		"/coubs/abc":                                 "coubs",
+		"/search/coubs":                              "search/coubs",
+	}
+	for path, want := range tests {
+		if got := endpointName(path); got != want {
+			t.Errorf("endpointName(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
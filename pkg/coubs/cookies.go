@@ -3,9 +3,13 @@ package coubs
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type KV struct {
@@ -13,7 +17,10 @@ type KV struct {
 	Value string
 }
 
-const headersKey = "http_headers"
+const (
+	headersKey          = "http_headers"
+	headersRefreshedKey = "http_headers_refreshed_at"
+)
 
 type Cookies struct {
 	db *gorm.DB
@@ -62,9 +69,51 @@ func (c *Cookies) Get() (*State, error) {
 	return ParseState(headers)
 }
 
-func (c *Cookies) Update(req *http.Request, resp *http.Response) error {
-	// TODO:
-	return nil
+// Update merges cookies set by the response into the stored request headers.
+// The headers are rewritten in a single transaction, and the time of the
+// update is saved under headersRefreshedKey.
+func (c *Cookies) Update(resp *http.Response) error {
+	updates := resp.Cookies()
+	if len(updates) == 0 {
+		return nil
+	}
+
+	return c.db.Transaction(func(tx *gorm.DB) error {
+		kv := KV{}
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("key = ?", headersKey).First(&kv).Error
+		if err != nil {
+			return err
+		}
+
+		st, err := ParseState(kv.Value)
+		if err != nil {
+			return err
+		}
+
+		if !st.MergeCookies(updates, time.Now()) {
+			return nil
+		}
+
+		err = tx.Model(&KV{}).Where("key = ?", headersKey).Update("value", st.Headers()).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Save(&KV{
+			Key:   headersRefreshedKey,
+			Value: time.Now().UTC().Format(time.RFC3339),
+		}).Error
+	})
+}
+
+// LastRefreshed returns the time of the last session update, or zero time
+// if cookies were never updated.
+func (c *Cookies) LastRefreshed() (time.Time, error) {
+	value, err := c.GetOrSet(headersRefreshedKey, "")
+	if err != nil || value == "" {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, value)
 }
 
 type State struct {
@@ -83,3 +132,60 @@ func ParseState(headers string) (*State, error) {
 		Request: req,
 	}, nil
 }
+
+// MergeCookies applies Set-Cookie updates to the Cookie header, removing
+// expired cookies. Returns true if the header was changed.
+func (s *State) MergeCookies(updates []*http.Cookie, now time.Time) bool {
+	current := s.Request.Cookies()
+	changed := false
+
+	for _, update := range updates {
+		expired := update.MaxAge < 0 || (!update.Expires.IsZero() && update.Expires.Before(now))
+
+		found := false
+		for i, cookie := range current {
+			if cookie.Name != update.Name {
+				continue
+			}
+			found = true
+			if expired {
+				current = append(current[:i], current[i+1:]...)
+				changed = true
+			} else if cookie.Value != update.Value {
+				cookie.Value = update.Value
+				changed = true
+			}
+			break
+		}
+
+		if !found && !expired {
+			current = append(current, &http.Cookie{Name: update.Name, Value: update.Value})
+			changed = true
+		}
+	}
+
+	if !changed {
+		return false
+	}
+
+	pairs := make([]string, 0, len(current))
+	for _, cookie := range current {
+		pairs = append(pairs, cookie.Name+"="+cookie.Value)
+	}
+	s.Request.Header.Set("Cookie", strings.Join(pairs, "; "))
+	return true
+}
+
+// Headers serializes the request back to the format accepted by ParseState.
+func (s *State) Headers() string {
+	req := s.Request
+
+	b := &strings.Builder{}
+	_, _ = fmt.Fprintf(b, "%s %s %s\r\n", req.Method, req.RequestURI, req.Proto)
+	if req.Host != "" {
+		_, _ = fmt.Fprintf(b, "Host: %s\r\n", req.Host)
+	}
+	_ = req.Header.Write(b)
+
+	return strings.TrimRight(b.String(), "\r\n")
+}
@@ -0,0 +1,122 @@
+package coubs
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMergeCookies(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		updates     []*http.Cookie
+		wantChanged bool
+		wantCookie  string
+	}{
+		{
+			name:       "no updates",
+			wantCookie: "remember_token=abc; session=1",
+		},
+		{
+			name:       "same value",
+			updates:    []*http.Cookie{{Name: "session", Value: "1"}},
+			wantCookie: "remember_token=abc; session=1",
+		},
+		{
+			name:        "new value",
+			updates:     []*http.Cookie{{Name: "session", Value: "2"}},
+			wantChanged: true,
+			wantCookie:  "remember_token=abc; session=2",
+		},
+		{
+			name:        "new cookie",
+			updates:     []*http.Cookie{{Name: "csrf", Value: "x"}},
+			wantChanged: true,
+			wantCookie:  "remember_token=abc; session=1; csrf=x",
+		},
+		{
+			name:        "deleted with max age",
+			updates:     []*http.Cookie{{Name: "remember_token", MaxAge: -1}},
+			wantChanged: true,
+			wantCookie:  "session=1",
+		},
+		{
+			name:        "expired",
+			updates:     []*http.Cookie{{Name: "session", Value: "2", Expires: now.Add(-time.Hour)}},
+			wantChanged: true,
+			wantCookie:  "remember_token=abc",
+		},
+		{
+			name:        "expires in future",
+			updates:     []*http.Cookie{{Name: "session", Value: "2", Expires: now.Add(time.Hour)}},
+			wantChanged: true,
+			wantCookie:  "remember_token=abc; session=2",
+		},
+		{
+			name:       "expired unknown cookie",
+			updates:    []*http.Cookie{{Name: "csrf", MaxAge: -1}},
+			wantCookie: "remember_token=abc; session=1",
+		},
+		{
+			name: "several updates",
+			updates: []*http.Cookie{
+				{Name: "remember_token", MaxAge: -1},
+				{Name: "session", Value: "3"},
+				{Name: "csrf", Value: "y"},
+			},
+			wantChanged: true,
+			wantCookie:  "session=3; csrf=y",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := ParseState(testHeaders)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			changed := st.MergeCookies(tt.updates, now)
+			if changed != tt.wantChanged {
+				t.Errorf("changed = %v, want %v", changed, tt.wantChanged)
+			}
+			if cookie := st.Request.Header.Get("Cookie"); cookie != tt.wantCookie {
+				t.Errorf("cookie = %q, want %q", cookie, tt.wantCookie)
+			}
+		})
+	}
+}
+
+func TestHeadersRoundTrip(t *testing.T) {
+	st, err := ParseState(testHeaders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.MergeCookies([]*http.Cookie{{Name: "session", Value: "2"}}, time.Now())
+
+	parsed, err := ParseState(st.Headers())
+	if err != nil {
+		t.Fatalf("serialized headers can't be parsed: %v\n%s", err, st.Headers())
+	}
+
+	req := parsed.Request
+	if req.Method != http.MethodGet || req.RequestURI != "/api/v2/timeline" || req.Proto != "HTTP/1.1" {
+		t.Errorf("request line changed: %s %s %s", req.Method, req.RequestURI, req.Proto)
+	}
+	if req.Host != "coub.com" {
+		t.Errorf("host = %q", req.Host)
+	}
+	if cookie := req.Header.Get("Cookie"); cookie != "remember_token=abc; session=2" {
+		t.Errorf("cookie = %q", cookie)
+	}
+	if agent := req.Header.Get("User-Agent"); agent != "test" {
+		t.Errorf("user agent = %q", agent)
+	}
+
+	// serializing is stable, so unchanged sessions are not rewritten
+	if again := parsed.Headers(); again != st.Headers() {
+		t.Errorf("headers changed after round trip:\n%s\n%s", st.Headers(), again)
+	}
+}
@@ -0,0 +1,68 @@
+package coubs
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rwlist/coub/pkg/retry"
+)
+
+var (
+	ErrSessionExpired = errors.New("coub session expired")
+	ErrRateLimited    = errors.New("coub rate limit exceeded")
+	ErrNotFound       = errors.New("coub resource not found")
+)
+
+const maxErrorBody = 512
+
+// APIError is returned when Coub API responds with a non-2xx status or with
+// something that is not JSON.
+type APIError struct {
+	Endpoint   string
+	StatusCode int
+	Body       string
+	Wait       time.Duration
+}
+
+func newAPIError(endpoint string, resp *http.Response, body []byte) *APIError {
+	excerpt := strings.TrimSpace(string(body))
+	if len(excerpt) > maxErrorBody {
+		excerpt = excerpt[:maxErrorBody] + "..."
+	}
+
+	return &APIError{
+		Endpoint:   endpoint,
+		StatusCode: resp.StatusCode,
+		Body:       excerpt,
+		Wait:       retry.ParseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("coub api %s: status %d: %s", e.Endpoint, e.StatusCode, e.Body)
+}
+
+// Temporary reports whether the request may succeed if repeated.
+func (e *APIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
+
+func (e *APIError) RetryAfter() time.Duration {
+	return e.Wait
+}
+
+func (e *APIError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrSessionExpired
+	case http.StatusTooManyRequests:
+		return ErrRateLimited
+	case http.StatusNotFound:
+		return ErrNotFound
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,138 @@
+package coubs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// PageFunc fetches a single page of a timeline, pages are numbered from 1.
+type PageFunc func(ctx context.Context, page int) (*PageResponse, error)
+
+// ErrStop can be returned from Each callback to stop iteration early.
+var ErrStop = errors.New("stop iteration")
+
+// Iterator walks over coubs of a paginated timeline, fetching pages lazily.
+//
+//	it := NewIterator(client.Likes, 1)
+//	for it.Next(ctx) {
+//		process(it.Coub())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator struct {
+	fetch    PageFunc
+	page     int
+	response *PageResponse
+	index    int
+	err      error
+	done     bool
+	complete bool
+}
+
+func NewIterator(fetch PageFunc, startPage int) *Iterator {
+	if startPage < 1 {
+		startPage = 1
+	}
+	return &Iterator{
+		fetch: fetch,
+		page:  startPage,
+		index: -1,
+	}
+}
+
+// Next advances to the next coub, fetching the next page if needed. Returns
+// false when the timeline is over or an error occurred.
+func (it *Iterator) Next(ctx context.Context) bool {
+	if it.done {
+		return false
+	}
+
+	it.index++
+	for it.response == nil || it.index >= len(it.response.Coubs) {
+		if it.response != nil {
+			if it.page >= it.response.TotalPages {
+				it.done = true
+				it.complete = true
+				return false
+			}
+			it.page++
+		}
+
+		response, err := it.fetch(ctx, it.page)
+		if err != nil {
+			it.err = err
+			it.done = true
+			return false
+		}
+		if len(response.Coubs) == 0 {
+			// the timeline could shrink while it was walked, then the page
+			// is past the new end, otherwise the page is missing
+			it.done = true
+			it.complete = it.page > response.TotalPages
+			return false
+		}
+
+		it.response = response
+		it.index = 0
+	}
+
+	return true
+}
+
+// Each calls fn for every remaining coub. Returning ErrStop from fn stops
+// iteration without error.
+func (it *Iterator) Each(ctx context.Context, fn func(it *Iterator) error) error {
+	for it.Next(ctx) {
+		err := fn(it)
+		if errors.Is(err, ErrStop) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+func (it *Iterator) Coub() json.RawMessage {
+	return it.response.Coubs[it.index]
+}
+
+// Page returns the number of the current page.
+func (it *Iterator) Page() int {
+	return it.page
+}
+
+// Index returns the position of the current coub in the page.
+func (it *Iterator) Index() int {
+	return it.index
+}
+
+// LastInPage reports whether the current coub is the last one in the page.
+func (it *Iterator) LastInPage() bool {
+	return it.response != nil && it.index == len(it.response.Coubs)-1
+}
+
+func (it *Iterator) TotalPages() int {
+	if it.response == nil {
+		return 0
+	}
+	return it.response.TotalPages
+}
+
+// Response returns the current page as it was received from the API.
+func (it *Iterator) Response() *PageResponse {
+	return it.response
+}
+
+// Complete reports whether the iteration ended at the last page of the
+// timeline. It's false after an error or an unexpected empty page.
+func (it *Iterator) Complete() bool {
+	return it.complete
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
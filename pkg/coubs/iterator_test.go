@@ -0,0 +1,197 @@
+package coubs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// fakeTimeline serves pages of coub ids, pages[0] is page 1.
+type fakeTimeline struct {
+	pages      [][]int
+	totalPages int
+	errPage    int
+	fetched    []int
+}
+
+var errFetch = errors.New("fetch failed")
+
+func (f *fakeTimeline) fetch(_ context.Context, page int) (*PageResponse, error) {
+	f.fetched = append(f.fetched, page)
+	if page == f.errPage {
+		return nil, errFetch
+	}
+
+	res := &PageResponse{Page: page, PerPage: 2, TotalPages: f.totalPages}
+	if page <= len(f.pages) {
+		for _, id := range f.pages[page-1] {
+			res.Coubs = append(res.Coubs, json.RawMessage(fmt.Sprintf(`{"id":%d}`, id)))
+		}
+	}
+	return res, nil
+}
+
+func collect(t *testing.T, it *Iterator) []int {
+	t.Helper()
+
+	var ids []int
+	for it.Next(context.Background()) {
+		var coub Coub
+		if err := json.Unmarshal(it.Coub(), &coub); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, coub.ID)
+	}
+	return ids
+}
+
+func TestIterator(t *testing.T) {
+	tests := []struct {
+		name         string
+		timeline     fakeTimeline
+		startPage    int
+		wantIDs      []int
+		wantFetched  []int
+		wantErr      error
+		wantComplete bool
+	}{
+		{
+			name:         "all pages",
+			timeline:     fakeTimeline{pages: [][]int{{1, 2}, {3, 4}, {5}}, totalPages: 3},
+			startPage:    1,
+			wantIDs:      []int{1, 2, 3, 4, 5},
+			wantFetched:  []int{1, 2, 3},
+			wantComplete: true,
+		},
+		{
+			name:         "resume from page",
+			timeline:     fakeTimeline{pages: [][]int{{1, 2}, {3, 4}, {5}}, totalPages: 3},
+			startPage:    2,
+			wantIDs:      []int{3, 4, 5},
+			wantFetched:  []int{2, 3},
+			wantComplete: true,
+		},
+		{
+			name:         "invalid start page",
+			timeline:     fakeTimeline{pages: [][]int{{1, 2}}, totalPages: 1},
+			startPage:    0,
+			wantIDs:      []int{1, 2},
+			wantFetched:  []int{1},
+			wantComplete: true,
+		},
+		{
+			name:        "empty page in the middle",
+			timeline:    fakeTimeline{pages: [][]int{{1, 2}, {}, {5}}, totalPages: 3},
+			startPage:   1,
+			wantIDs:     []int{1, 2},
+			wantFetched: []int{1, 2},
+		},
+		{
+			name:         "empty timeline",
+			timeline:     fakeTimeline{totalPages: 0},
+			startPage:    1,
+			wantFetched:  []int{1},
+			wantComplete: true,
+		},
+		{
+			name:         "timeline shrank",
+			timeline:     fakeTimeline{pages: [][]int{{1, 2}, {3, 4}}, totalPages: 2},
+			startPage:    3,
+			wantFetched:  []int{3},
+			wantComplete: true,
+		},
+		{
+			name:        "error",
+			timeline:    fakeTimeline{pages: [][]int{{1, 2}, {3, 4}, {5}}, totalPages: 3, errPage: 2},
+			startPage:   1,
+			wantIDs:     []int{1, 2},
+			wantFetched: []int{1, 2},
+			wantErr:     errFetch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timeline := tt.timeline
+			it := NewIterator(timeline.fetch, tt.startPage)
+
+			ids := collect(t, it)
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("ids = %v, want %v", ids, tt.wantIDs)
+			}
+			if !reflect.DeepEqual(timeline.fetched, tt.wantFetched) {
+				t.Errorf("fetched pages = %v, want %v", timeline.fetched, tt.wantFetched)
+			}
+			if !errors.Is(it.Err(), tt.wantErr) {
+				t.Errorf("err = %v, want %v", it.Err(), tt.wantErr)
+			}
+			if it.Complete() != tt.wantComplete {
+				t.Errorf("complete = %v, want %v", it.Complete(), tt.wantComplete)
+			}
+
+			// stopped iterator stays stopped
+			if it.Next(context.Background()) {
+				t.Error("Next returned true after the end")
+			}
+		})
+	}
+}
+
+func TestIteratorPosition(t *testing.T) {
+	timeline := fakeTimeline{pages: [][]int{{1, 2}, {3}}, totalPages: 2}
+	it := NewIterator(timeline.fetch, 1)
+
+	type position struct {
+		page, index int
+		last        bool
+	}
+	var got []position
+	for it.Next(context.Background()) {
+		got = append(got, position{it.Page(), it.Index(), it.LastInPage()})
+	}
+
+	want := []position{{1, 0, false}, {1, 1, true}, {2, 0, true}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("positions = %v, want %v", got, want)
+	}
+}
+
+func TestIteratorEachStop(t *testing.T) {
+	timeline := fakeTimeline{pages: [][]int{{1, 2}, {3, 4}}, totalPages: 2}
+	it := NewIterator(timeline.fetch, 1)
+
+	count := 0
+	err := it.Each(context.Background(), func(it *Iterator) error {
+		count++
+		if count == 3 {
+			return ErrStop
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("count = %d, want 3", count)
+	}
+
+	// the rest of the timeline can still be walked
+	if ids := collect(t, it); !reflect.DeepEqual(ids, []int{4}) {
+		t.Errorf("ids after stop = %v, want [4]", ids)
+	}
+}
+
+func TestIteratorEachError(t *testing.T) {
+	timeline := fakeTimeline{pages: [][]int{{1, 2}}, totalPages: 1}
+	it := NewIterator(timeline.fetch, 1)
+
+	err := it.Each(context.Background(), func(it *Iterator) error {
+		return errFetch
+	})
+	if !errors.Is(err, errFetch) {
+		t.Errorf("err = %v, want %v", err, errFetch)
+	}
+}
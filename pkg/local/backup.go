@@ -1,9 +1,15 @@
 package local
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
+	"github.com/rwlist/coub/pkg/conf"
 	"github.com/rwlist/coub/pkg/coubs"
+	"github.com/rwlist/coub/pkg/retry"
 	log "github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
@@ -12,125 +18,225 @@ type Backup struct {
 	downloader *Downloader
 	client     *coubs.Client
 	db         *gorm.DB
-	state      *SharedState
+	tracker    *Tracker
+	workers    int
+	stopAfter  int
+	verifyAge  time.Duration
+	refreshAge time.Duration
 }
 
-func NewBackup(downloader *Downloader, client *coubs.Client, db *gorm.DB, state *SharedState) *Backup {
+func NewBackup(downloader *Downloader, client *coubs.Client, db *gorm.DB, tracker *Tracker, cfg *conf.App) *Backup {
 	return &Backup{
 		downloader: downloader,
 		client:     client,
 		db:         db,
-		state:      state,
+		tracker:    tracker,
+		workers:    cfg.DownloadWorkers,
+		stopAfter:  cfg.IncrementalStopAfter,
+		verifyAge:  cfg.VerifyInterval,
+		refreshAge: cfg.RefreshInterval,
 	}
 }
 
-func (b *Backup) Profile(profile string) error {
-	page := 1
-	for {
-		b.state.DownloadingProfilePage(profile, page)
+// Profile archives all coubs of the profile, resuming from the checkpoint.
+func (b *Backup) Profile(ctx context.Context, profile string) error {
+	return b.Run(ctx, Job{Kind: JobProfile, Target: profile, Mode: ModeFull})
+}
+
+// Likes archives all coubs liked by the account of the stored session, they
+// are saved under profile.
+func (b *Backup) Likes(ctx context.Context, profile string) error {
+	return b.Run(ctx, Job{Kind: JobLikes, Target: profile, Mode: ModeFull})
+}
 
+// Favorites archives all favorite coubs of the account of the stored
+// session, they are saved under profile.
+func (b *Backup) Favorites(ctx context.Context, profile string) error {
+	return b.Run(ctx, Job{Kind: JobFavorites, Target: profile, Mode: ModeFull})
+}
+
+func (b *Backup) profile(ctx context.Context, job Job) error {
+	fetch := func(ctx context.Context, page int) (*coubs.PageResponse, error) {
 		log.WithField("page", page).Info("Fetching profile page")
-		pageResponse, err := b.client.ChannelTimeline(profile, page)
-		if err != nil {
-			return err
-		}
-		if len(pageResponse.Coubs) == 0 {
-			break
-		}
+		return b.client.ChannelTimeline(ctx, job.Target, page)
+	}
+	return b.archiveMembers(ctx, job, fetch)
+}
 
-		b.state.GotProfilePage(profile, page, pageResponse)
+func (b *Backup) likes(ctx context.Context, job Job) error {
+	fetch := func(ctx context.Context, page int) (*coubs.PageResponse, error) {
+		log.WithField("page", page).Info("Fetching likes page")
+		return b.client.Likes(ctx, page)
+	}
+	return b.archiveMembers(ctx, job, fetch)
+}
 
-		for index, rawCoub := range pageResponse.Coubs {
-			b.state.DownloadingCoub(profile, page, index, rawCoub)
+func (b *Backup) favorites(ctx context.Context, job Job) error {
+	fetch := func(ctx context.Context, page int) (*coubs.PageResponse, error) {
+		log.WithField("page", page).Info("Fetching favorites page")
+		return b.client.Favorites(ctx, page)
+	}
+	return b.archiveMembers(ctx, job, fetch)
+}
 
-			err := b.downloader.DownloadCoub(rawCoub)
-			if err != nil {
-				return err
-			}
+// archiveMembers archives the timeline and adds its coubs to the table
+// of the job kind.
+func (b *Backup) archiveMembers(ctx context.Context, job Job, fetch coubs.PageFunc) error {
+	return b.archive(ctx, job, fetch, func(ctx context.Context, item *timelineItem) (bool, error) {
+		return b.saveMember(ctx, job, item)
+	})
+}
 
-			var coub coubs.Coub
-			err = json.Unmarshal(rawCoub, &coub)
-			if err != nil {
-				return err
-			}
+// Timeline archives all coubs from an arbitrary timeline, such as tag,
+// community or search results, see timelineFetch. Only SavedCoub rows are
+// created.
+func (b *Backup) Timeline(ctx context.Context, timeline string) error {
+	return b.Run(ctx, Job{Kind: JobTimeline, Target: timeline, Mode: ModeFull})
+}
 
-			// check if exists in db
-			var count int64
-			err = b.db.Model(&ProfileCoub{}).Where("profile = ? AND coub_id = ?", profile, coub.ID).Count(&count).Error
-			if err != nil {
-				return err
-			}
-			if count > 0 {
-				continue
-			}
+func (b *Backup) timeline(ctx context.Context, job Job) error {
+	pages, err := timelineFetch(b.client, job.Target)
+	if err != nil {
+		return err
+	}
+	fetch := func(ctx context.Context, page int) (*coubs.PageResponse, error) {
+		log.WithField("timeline", job.Target).WithField("page", page).Info("Fetching timeline page")
+		return pages(ctx, page)
+	}
 
-			if err := b.db.Create(&ProfileCoub{
-				Profile:     profile,
-				CoubID:      coub.ID,
-				PublishedAt: coub.PublishedAt,
-				Info:        rawCoub,
-			}).Error; err != nil {
-				return err
-			}
-		}
+	return b.archive(ctx, job, fetch, func(ctx context.Context, item *timelineItem) (bool, error) {
+		return false, b.checkDownload(ctx, job, item)
+	})
+}
 
-		page++
-		if page > pageResponse.TotalPages {
-			break
+// timelineFetch returns pages of the timeline, described as "hot",
+// "featured", "tag:<tag>", "community:<community>[/<section>]" or
+// "search:<text>". client may be nil to only validate the timeline.
+func timelineFetch(client *coubs.Client, timeline string) (coubs.PageFunc, error) {
+	kind, arg, _ := strings.Cut(timeline, ":")
+	switch {
+	case timeline == "hot":
+		return client.HotTimeline, nil
+	case timeline == "featured":
+		return client.FeaturedTimeline, nil
+	case kind == "tag" && arg != "":
+		return func(ctx context.Context, page int) (*coubs.PageResponse, error) {
+			return client.TagTimeline(ctx, arg, page)
+		}, nil
+	case kind == "community" && arg != "":
+		community, section, _ := strings.Cut(arg, "/")
+		if section == "" {
+			section = coubs.CommunityFresh
 		}
+		return func(ctx context.Context, page int) (*coubs.PageResponse, error) {
+			return client.CommunityTimeline(ctx, community, section, page)
+		}, nil
+	case kind == "search" && arg != "":
+		return func(ctx context.Context, page int) (*coubs.PageResponse, error) {
+			return client.Search(ctx, arg, page)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown timeline %q", timeline)
 	}
+}
 
-	return nil
+// checkDownload queues the failed download of the item for later retries.
+// Only errors that stop the whole backup are returned.
+func (b *Backup) checkDownload(ctx context.Context, job Job, item *timelineItem) error {
+	if item.Err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if errors.Is(item.Err, coubs.ErrSessionExpired) {
+		return item.Err
+	}
+
+	return b.downloader.RecordFailure(ctx, job, item.Raw, item.Err)
 }
 
-func (b *Backup) Likes(profile string) error {
-	page := 1
-	for {
-		log.WithField("page", page).Info("Fetching likes page")
-		pageResponse, err := b.client.Likes(page)
-		if err != nil {
-			return err
-		}
-		if len(pageResponse.Coubs) == 0 {
-			break
-		}
+// markRemoved marks coubs of the job, that were not seen since the given
+// time, as removed from the timeline. Rows are never deleted.
+func (b *Backup) markRemoved(ctx context.Context, job Job, since time.Time) error {
+	model := memberModel(job.Kind)
+	if model == nil {
+		return nil
+	}
 
-		for _, rawCoub := range pageResponse.Coubs {
-			err := b.downloader.DownloadCoub(rawCoub)
-			if err != nil {
-				return err
-			}
+	res := b.db.WithContext(ctx).Model(model).
+		Where("profile = ? AND removed_at IS NULL AND (last_seen_at IS NULL OR last_seen_at < ?)", job.Target, since).
+		Update("removed_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected > 0 {
+		log.WithField("job", job.String()).WithField("count", res.RowsAffected).Info("Marked coubs as removed")
+	}
+	return nil
+}
 
-			var coub coubs.Coub
-			err = json.Unmarshal(rawCoub, &coub)
-			if err != nil {
-				return err
-			}
+// saveMember adds the coub to the table of the job kind, unless the profile
+// already has it there. Returns true if the coub was saved before. Coubs
+// without archived media are not added here, a failed download is added
+// when it's retried successfully, see Downloader.resolveFailure.
+func (b *Backup) saveMember(ctx context.Context, job Job, item *timelineItem) (bool, error) {
+	err := b.checkDownload(ctx, job, item)
+	if err != nil {
+		return false, err
+	}
+	if item.Err != nil || item.Coub.ID == 0 {
+		return false, nil
+	}
 
-			// check if exists in db
-			var count int64
-			err = b.db.Model(&LikedCoub{}).Where("profile = ? AND coub_id = ?", profile, coub.ID).Count(&count).Error
-			if err != nil {
-				return err
-			}
-			if count > 0 {
-				continue
-			}
+	// mark as seen if exists in db
+	now := time.Now()
+	res := b.db.WithContext(ctx).Model(memberModel(job.Kind)).
+		Where("profile = ? AND coub_id = ?", job.Target, item.Coub.ID).
+		Updates(map[string]interface{}{
+			"last_seen_at": now,
+			"removed_at":   nil,
+		})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected > 0 {
+		return true, nil
+	}
 
-			if err := b.db.Create(&LikedCoub{
-				Profile: profile,
-				CoubID:  coub.ID,
-				Info:    rawCoub,
-			}).Error; err != nil {
-				return err
-			}
-		}
+	return false, b.db.WithContext(ctx).Create(memberRow(job.Kind, job.Target, &item.Coub, item.Raw, now)).Error
+}
 
-		page++
-		if page > pageResponse.TotalPages {
-			break
+const maxRateLimitPauses = 10
+
+// withPauses reacts to API errors that should not abort a backup. The client
+// retries short rate limits itself, a request rate limited for longer is
+// repeated after the Retry-After pause. A missing timeline is treated as
+// an empty one, unless it's a page in the middle of the timeline. Expired
+// session and other errors are returned to the caller.
+func withPauses(fetch coubs.PageFunc) coubs.PageFunc {
+	return func(ctx context.Context, page int) (*coubs.PageResponse, error) {
+		for pauses := 0; ; pauses++ {
+			pageResponse, err := fetch(ctx, page)
+			var apiErr *coubs.APIError
+			switch {
+			case err == nil:
+				return pageResponse, nil
+
+			case errors.Is(err, coubs.ErrRateLimited) && errors.As(err, &apiErr) &&
+				apiErr.RetryAfter() > 0 && pauses < maxRateLimitPauses:
+				log.WithError(err).WithField("page", page).WithField("pause", apiErr.RetryAfter().String()).Warn("Rate limited, pausing")
+				if err := retry.Sleep(ctx, apiErr.RetryAfter()); err != nil {
+					return nil, err
+				}
+
+			case errors.Is(err, coubs.ErrNotFound) && page == 1:
+				log.WithError(err).WithField("page", page).Warn("Timeline not found, skipping")
+				return &coubs.PageResponse{Page: page}, nil
+
+			default:
+				return nil, fmt.Errorf("fetch page %d: %w", page, err)
+			}
 		}
 	}
-
-	return nil
 }
@@ -0,0 +1,64 @@
+package local
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// loadCheckpoint returns the checkpoint to start the job from. Incremental
+// jobs, rescans and jobs completed before start over from the first page.
+func (b *Backup) loadCheckpoint(ctx context.Context, job Job) (*Checkpoint, error) {
+	fresh := &Checkpoint{
+		Kind:      string(job.Kind),
+		Target:    job.Target,
+		StartedAt: time.Now(),
+	}
+	if job.Rescan || job.Mode == ModeIncremental {
+		return fresh, nil
+	}
+
+	var checkpoint Checkpoint
+	err := b.db.WithContext(ctx).
+		Where("kind = ? AND target = ?", job.Kind, job.Target).
+		Limit(1).
+		Find(&checkpoint).Error
+	if err != nil {
+		return nil, err
+	}
+	if checkpoint.Completed || checkpoint.Page == 0 {
+		return fresh, nil
+	}
+
+	log.WithField("job", job.String()).WithField("page", checkpoint.Page).Info("Resuming backup from checkpoint")
+	return &checkpoint, nil
+}
+
+// startPage returns the page to start from. An interrupted job is resumed
+// from its last processed page, not the next one, because coubs removed
+// from the timeline shift the following pages back.
+func (c *Checkpoint) startPage() int {
+	if c.Page < 1 {
+		return 1
+	}
+	return c.Page
+}
+
+func (b *Backup) saveCheckpoint(ctx context.Context, checkpoint *Checkpoint) error {
+	return b.db.WithContext(ctx).Save(checkpoint).Error
+}
+
+// lastFullSync returns the time when the last full run of the job was
+// completed, or zero time if it's unknown.
+func (b *Backup) lastFullSync(ctx context.Context, job Job) (time.Time, error) {
+	var checkpoint Checkpoint
+	err := b.db.WithContext(ctx).
+		Where("kind = ? AND target = ? AND completed", job.Kind, job.Target).
+		Limit(1).
+		Find(&checkpoint).Error
+	if err != nil {
+		return time.Time{}, err
+	}
+	return checkpoint.UpdatedAt, nil
+}
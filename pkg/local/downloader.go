@@ -1,53 +1,119 @@
 package local
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/rwlist/coub/pkg/conf"
 	"github.com/rwlist/coub/pkg/coubs"
+	"github.com/rwlist/coub/pkg/metrics"
+	"github.com/rwlist/coub/pkg/retry"
+	"github.com/rwlist/coub/pkg/storage"
 	log "github.com/sirupsen/logrus"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// Download stages, saved in FailedDownload.Stage.
+const (
+	StageMetadata = "metadata"
+	StageVideo    = "video"
+	StageAudio    = "audio"
+	StageSave     = "save"
+)
+
+// StageError tells at which stage the download has failed.
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return e.Stage + ": " + e.Err.Error()
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
 type Downloader struct {
-	client *coubs.Client
-	s3     *s3.S3
-	db     *gorm.DB
-	cfg    *conf.App
+	client  *coubs.Client
+	storage storage.Storage
+	db      *gorm.DB
+	retry   retry.Policy
+	// media is downloaded from the CDN, not the API, so it has own limits
+	httpClient *http.Client
+	limiter    *retry.Limiter
+
+	failedRetryBase   time.Duration
+	failedMaxAttempts int
+	shutdownGrace     time.Duration
 }
 
-func NewDownloader(client *coubs.Client, s3cli *s3.S3, db *gorm.DB, cfg *conf.App) *Downloader {
+func NewDownloader(client *coubs.Client, store storage.Storage, db *gorm.DB, cfg *conf.App) *Downloader {
 	return &Downloader{
-		client: client,
-		s3:     s3cli,
-		db:     db,
-		cfg:    cfg,
+		client:  client,
+		storage: store,
+		db:      db,
+		retry: retry.Policy{
+			MaxAttempts: cfg.RetryAttempts,
+			BaseDelay:   cfg.RetryBaseDelay,
+			MaxDelay:    cfg.RetryMaxDelay,
+		},
+		httpClient:        &http.Client{Timeout: cfg.DownloadTimeout},
+		limiter:           retry.NewLimiter(cfg.DownloadRateLimit),
+		failedRetryBase:   cfg.FailedRetryDelay,
+		failedMaxAttempts: cfg.FailedMaxAttempts,
+		shutdownGrace:     cfg.ShutdownTimeout,
 	}
 }
 
-func (d *Downloader) DownloadCoub(rawCoub []byte) error {
+// graceful returns a context for downloads, which outlives ctx by the
+// shutdown grace period. Downloads started before shutdown get a chance
+// to finish instead of being thrown away.
+func (d *Downloader) graceful(ctx context.Context) (context.Context, context.CancelFunc) {
+	workCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		select {
+		case <-time.After(d.shutdownGrace):
+			log.WithField("grace", d.shutdownGrace).Warn("Shutdown grace period is over, cancelling downloads")
+		case <-workCtx.Done():
+		}
+		cancel()
+	})
+
+	return workCtx, func() {
+		stop()
+		cancel()
+	}
+}
+
+func (d *Downloader) DownloadCoub(ctx context.Context, rawCoub []byte) error {
 	var coub coubs.Coub
 	err := json.Unmarshal(rawCoub, &coub)
 	if err != nil {
 		spew.Dump(rawCoub)
-		return err
+		return &StageError{Stage: StageMetadata, Err: err}
 	}
 
 	var count int64
-	err = d.db.Model(&SavedCoub{}).Where("coub_id = ?", coub.ID).Count(&count).Error
+	err = d.db.WithContext(ctx).Model(&SavedCoub{}).Where("coub_id = ?", coub.ID).Count(&count).Error
 	if err != nil {
-		return err
+		return &StageError{Stage: StageSave, Err: err}
 	}
 	if count > 0 {
 		log.WithField("coub_id", coub.ID).Info("coub was downloaded before")
+		// it may have been queued before another job downloaded it
+		err = d.resolveFailure(ctx, &coub, rawCoub)
+		if err != nil {
+			return &StageError{Stage: StageSave, Err: err}
+		}
 		return nil
 	}
 
@@ -55,12 +121,12 @@ func (d *Downloader) DownloadCoub(rawCoub []byte) error {
 
 	videoURL, err := bestURL(coub.FileVersions.HTML5.Video)
 	if err != nil {
-		return err
+		return &StageError{Stage: StageVideo, Err: err}
 	}
 	videoKey := fmt.Sprintf("%d_video.mp4", coub.ID)
-	err = d.upload(videoURL, videoKey)
+	err = d.upload(ctx, StageVideo, videoURL, videoKey)
 	if err != nil {
-		return err
+		return &StageError{Stage: StageVideo, Err: err}
 	}
 
 	var noAudio bool
@@ -71,37 +137,108 @@ func (d *Downloader) DownloadCoub(rawCoub []byte) error {
 		log.WithField("coub_id", coub.ID).Info("coub has no audio")
 	} else {
 		audioKey := fmt.Sprintf("%d_audio.mp3", coub.ID)
-		if err := d.upload(audioURL, audioKey); err != nil {
-			return err
+		if err := d.upload(ctx, StageAudio, audioURL, audioKey); err != nil {
+			return &StageError{Stage: StageAudio, Err: err}
 		}
 	}
 
-	return d.db.Create(&SavedCoub{
+	// another worker may have saved the same coub in the meantime
+	err = d.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&SavedCoub{
 		CoubID:  coub.ID,
 		Info:    rawCoub,
 		NoAudio: noAudio,
 	}).Error
+	if err != nil {
+		return &StageError{Stage: StageSave, Err: err}
+	}
+
+	// the coub may have failed before
+	err = d.resolveFailure(ctx, &coub, rawCoub)
+	if err != nil {
+		return &StageError{Stage: StageSave, Err: err}
+	}
+	return nil
 }
 
-func (d *Downloader) upload(url, key string) error {
-	resp, err := http.Get(url) //nolint
+// DownloadPermalink fetches metadata of a single coub and archives it.
+func (d *Downloader) DownloadPermalink(ctx context.Context, permalink string) error {
+	rawCoub, err := d.client.Coub(ctx, permalink)
 	if err != nil {
 		return err
 	}
+
+	return d.DownloadCoub(ctx, rawCoub)
+}
+
+func (d *Downloader) upload(ctx context.Context, media, url, key string) error {
+	return d.retry.Do(ctx, func() error {
+		return d.tryUpload(ctx, media, url, key)
+	})
+}
+
+func (d *Downloader) tryUpload(ctx context.Context, media, url, key string) error {
+	err := d.limiter.Wait(ctx)
+	if err != nil {
+		return retry.Permanent(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return retry.Permanent(err)
+	}
+
+	started := time.Now()
+	resp, err := d.httpClient.Do(req)
+	metrics.DownloadDuration.WithLabelValues(media).Observe(time.Since(started).Seconds())
+	if err != nil {
+		if ctx.Err() != nil {
+			return retry.Permanent(err)
+		}
+		return err
+	}
 	defer resp.Body.Close()
 
-	var body []byte
-	body, err = io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("download %s: unexpected status %d", url, resp.StatusCode)
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+			return retry.After(err, retry.ParseRetryAfter(resp.Header.Get("Retry-After")))
+		}
+		return retry.Permanent(err)
+	}
+
+	body := &lengthReader{
+		r:        resp.Body,
+		expected: resp.ContentLength,
+	}
+	started = time.Now()
+	err = d.storage.Put(ctx, key, body, resp.ContentLength, resp.Header.Get("Content-Type"))
 	if err != nil {
 		return err
 	}
+	metrics.UploadDuration.WithLabelValues(media).Observe(time.Since(started).Seconds())
+	metrics.UploadedBytes.Add(float64(body.read))
 
-	_, err = d.s3.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(d.cfg.S3Bucket),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader(body),
-	})
-	return err
+	progressFrom(ctx).AddBytes(body.read)
+	return nil
+}
+
+// lengthReader fails with io.ErrUnexpectedEOF if the stream length differs
+// from the expected one, so that a truncated download never completes
+// an upload. Negative expected length disables the check.
+type lengthReader struct {
+	r        io.Reader
+	expected int64
+	read     int64
+}
+
+func (l *lengthReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+
+	if l.expected >= 0 && (l.read > l.expected || (err == io.EOF && l.read != l.expected)) {
+		return n, fmt.Errorf("%w: read %d bytes, expected %d", io.ErrUnexpectedEOF, l.read, l.expected)
+	}
+	return n, err
 }
 
 func bestURL(video coubs.Blobs) (string, error) {
@@ -0,0 +1,188 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/rwlist/coub/pkg/coubs"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const maxFailedRetryDelay = 24 * time.Hour
+
+// RecordFailure saves the failed download to the queue, or updates the queued
+// one, scheduling the next retry with exponential backoff. If job has a table
+// of timeline coubs, the coub is added there once it's downloaded.
+func (d *Downloader) RecordFailure(ctx context.Context, job Job, rawCoub json.RawMessage, downloadErr error) error {
+	var coub coubs.Coub
+	err := json.Unmarshal(rawCoub, &coub)
+	if err != nil || coub.ID == 0 {
+		log.WithError(downloadErr).Error("Failed to download coub with broken metadata")
+		return nil
+	}
+
+	stage := StageSave
+	var stageErr *StageError
+	if errors.As(downloadErr, &stageErr) {
+		stage = stageErr.Stage
+	}
+
+	log.WithError(downloadErr).WithField("coub_id", coub.ID).WithField("stage", stage).Warn("Coub download failed")
+
+	return d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		failed := FailedDownload{CoubID: coub.ID}
+		err := tx.Where("coub_id = ?", coub.ID).Limit(1).Find(&failed).Error
+		if err != nil {
+			return err
+		}
+
+		failed.Stage = stage
+		failed.Error = downloadErr.Error()
+		failed.Attempts++
+		failed.NextRetryAt = time.Now().Add(d.failedRetryDelay(failed.Attempts))
+		failed.Info = rawCoub
+		if memberModel(job.Kind) != nil {
+			err = failed.addTimeline(failedTimeline{Kind: job.Kind, Target: job.Target})
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Save(&failed).Error
+	})
+}
+
+// failedTimeline is a timeline, where the failed coub was found.
+type failedTimeline struct {
+	Kind   JobKind `json:"kind"`
+	Target string  `json:"target"`
+}
+
+func (f *FailedDownload) timelines() ([]failedTimeline, error) {
+	if len(f.Timelines) == 0 {
+		return nil, nil
+	}
+	var timelines []failedTimeline
+	err := json.Unmarshal(f.Timelines, &timelines)
+	return timelines, err
+}
+
+func (f *FailedDownload) addTimeline(timeline failedTimeline) error {
+	timelines, err := f.timelines()
+	if err != nil {
+		return err
+	}
+	for _, t := range timelines {
+		if t == timeline {
+			return nil
+		}
+	}
+
+	f.Timelines, err = json.Marshal(append(timelines, timeline))
+	return err
+}
+
+// resolveFailure removes the downloaded coub from the queue and adds it to
+// the timelines where it has failed before.
+func (d *Downloader) resolveFailure(ctx context.Context, coub *coubs.Coub, rawCoub json.RawMessage) error {
+	return d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var failed FailedDownload
+		res := tx.Where("coub_id = ?", coub.ID).Limit(1).Find(&failed)
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+
+		timelines, err := failed.timelines()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, t := range timelines {
+			row := memberRow(t.Kind, t.Target, coub, rawCoub, now)
+			if row == nil {
+				continue
+			}
+			// the timeline may have been archived again in the meantime
+			err = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(row).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Delete(&failed).Error
+	})
+}
+
+func (d *Downloader) failedRetryDelay(attempts int) time.Duration {
+	delay := d.failedRetryBase
+	for i := 1; i < attempts && delay < maxFailedRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxFailedRetryDelay {
+		delay = maxFailedRetryDelay
+	}
+	return delay
+}
+
+// RetryFailed repeats queued downloads that are due. Successful downloads are
+// removed from the queue and added to their timelines, see resolveFailure.
+func (d *Downloader) RetryFailed(ctx context.Context) error {
+	var failed []FailedDownload
+	err := d.db.WithContext(ctx).
+		Where("next_retry_at <= ? AND attempts < ?", time.Now(), d.failedMaxAttempts).
+		Order("next_retry_at ASC").
+		Find(&failed).Error
+	if err != nil {
+		return err
+	}
+
+	workCtx, cancel := d.graceful(ctx)
+	defer cancel()
+
+	for _, item := range failed {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.WithField("coub_id", item.CoubID).WithField("attempts", item.Attempts).Info("Retrying failed download")
+
+		err := d.DownloadCoub(workCtx, item.Info)
+		if workCtx.Err() != nil {
+			return workCtx.Err()
+		}
+		if err != nil {
+			err = d.RecordFailure(workCtx, Job{}, item.Info, err)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// RetryFailedLoop calls RetryFailed every interval until ctx is done.
+// Non-positive interval disables retries.
+func (d *Downloader) RetryFailedLoop(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := d.RetryFailed(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.WithError(err).Error("failed to retry failed downloads")
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package local
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rwlist/coub/pkg/coubs"
+	"github.com/rwlist/coub/pkg/storage"
+	"gorm.io/gorm"
+)
+
+const checkTimeout = 5 * time.Second
+
+type CheckResult struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type HealthStatus struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+type check func(ctx context.Context) error
+
+// Health checks dependencies of the service. /healthz covers the database
+// and the storage, /readyz also requires a valid Coub session, which is
+// checked at most once per sessionTTL to save the rate limit.
+type Health struct {
+	db      *gorm.DB
+	storage storage.Storage
+	client  *coubs.Client
+
+	sessionTTL time.Duration
+	sessionMux sync.Mutex
+	sessionAt  time.Time
+	sessionErr error
+}
+
+func NewHealth(db *gorm.DB, store storage.Storage, client *coubs.Client, sessionTTL time.Duration) *Health {
+	return &Health{
+		db:         db,
+		storage:    store,
+		client:     client,
+		sessionTTL: sessionTTL,
+	}
+}
+
+func (h *Health) checkPostgres(ctx context.Context) error {
+	sqlDB, err := h.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
+
+func (h *Health) checkSession(ctx context.Context) error {
+	h.sessionMux.Lock()
+	defer h.sessionMux.Unlock()
+
+	if !h.sessionAt.IsZero() && time.Since(h.sessionAt) < h.sessionTTL {
+		return h.sessionErr
+	}
+
+	// likes are only available with a valid session
+	_, err := h.client.Likes(ctx, 1)
+	if ctx.Err() != nil {
+		// don't cache the timeout of this check
+		return err
+	}
+	h.sessionAt = time.Now()
+	h.sessionErr = err
+	return err
+}
+
+func (h *Health) Healthz(w http.ResponseWriter, r *http.Request) {
+	h.serve(w, r, map[string]check{
+		"postgres": h.checkPostgres,
+		"storage":  h.storage.Check,
+	})
+}
+
+func (h *Health) Readyz(w http.ResponseWriter, r *http.Request) {
+	h.serve(w, r, map[string]check{
+		"postgres": h.checkPostgres,
+		"storage":  h.storage.Check,
+		"session":  h.checkSession,
+	})
+}
+
+// serve runs checks in parallel and responds with 503 if any of them failed.
+func (h *Health) serve(w http.ResponseWriter, r *http.Request, checks map[string]check) {
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	status := HealthStatus{
+		Status: "ok",
+		Checks: make(map[string]CheckResult, len(checks)),
+	}
+
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+	for name, fn := range checks {
+		wg.Add(1)
+		go func(name string, fn check) {
+			defer wg.Done()
+
+			started := time.Now()
+			err := fn(ctx)
+			res := CheckResult{
+				Status:   "ok",
+				Duration: time.Since(started).String(),
+			}
+			if err != nil {
+				res.Status = "fail"
+				res.Error = err.Error()
+			}
+
+			mux.Lock()
+			defer mux.Unlock()
+			status.Checks[name] = res
+			if err != nil {
+				status.Status = "fail"
+			}
+		}(name, fn)
+	}
+	wg.Wait()
+
+	if status.Status != "ok" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, status)
+}
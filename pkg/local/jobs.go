@@ -0,0 +1,165 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rwlist/coub/pkg/conf"
+	"github.com/rwlist/coub/pkg/coubs"
+)
+
+type JobKind string
+
+const (
+	JobProfile   JobKind = "profile"
+	JobLikes     JobKind = "likes"
+	JobFavorites JobKind = "favorites"
+	// JobVerify checks upstream status of all archived coubs, it has no target.
+	JobVerify JobKind = "verify"
+	// JobRefresh updates metadata of all archived coubs, it has no target.
+	JobRefresh JobKind = "refresh"
+	// JobTimeline archives coubs of an arbitrary timeline, see timelineFetch.
+	JobTimeline JobKind = "timeline"
+)
+
+type Mode string
+
+const (
+	// ModeFull walks the whole timeline, resuming from the checkpoint.
+	ModeFull Mode = "full"
+	// ModeIncremental walks the timeline from the newest coubs and stops
+	// when it reaches already archived ones.
+	ModeIncremental Mode = "incremental"
+)
+
+// Job is a single backup of one kind for one account.
+type Job struct {
+	Kind   JobKind
+	Target string
+	Mode   Mode
+	// Rescan starts from the first page, ignoring the saved checkpoint.
+	Rescan bool
+}
+
+func (j Job) String() string {
+	if j.Target == "" {
+		return string(j.Kind)
+	}
+	return string(j.Kind) + ":" + j.Target
+}
+
+// Jobs returns the list of backups enabled in the config. Likes and favorites
+// belong to the account of the stored session, they are saved under
+// COUB_USERNAME.
+func Jobs(cfg *conf.App) ([]Job, error) {
+	mode := Mode(cfg.BackupMode)
+	if mode != ModeFull && mode != ModeIncremental {
+		return nil, fmt.Errorf("unknown backup mode %q", cfg.BackupMode)
+	}
+
+	var jobs []Job
+	for _, profile := range cfg.BackupProfiles {
+		jobs = append(jobs, Job{Kind: JobProfile, Target: profile, Mode: mode, Rescan: cfg.BackupRescan})
+	}
+
+	if (cfg.BackupLikes || cfg.BackupFavorites) && cfg.CoubUsername == "" {
+		return nil, errors.New("COUB_USERNAME is required to backup likes and favorites")
+	}
+	if cfg.BackupLikes {
+		jobs = append(jobs, Job{Kind: JobLikes, Target: cfg.CoubUsername, Mode: mode, Rescan: cfg.BackupRescan})
+	}
+	if cfg.BackupFavorites {
+		jobs = append(jobs, Job{Kind: JobFavorites, Target: cfg.CoubUsername, Mode: mode, Rescan: cfg.BackupRescan})
+	}
+	// coubs of arbitrary timelines are not tracked, so an incremental run
+	// can't tell where to stop
+	for _, timeline := range cfg.BackupTimelines {
+		if _, err := timelineFetch(nil, timeline); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, Job{Kind: JobTimeline, Target: timeline, Mode: ModeFull, Rescan: cfg.BackupRescan})
+	}
+	if cfg.VerifyUpstream {
+		jobs = append(jobs, Job{Kind: JobVerify})
+	}
+	if cfg.RefreshMetadata {
+		jobs = append(jobs, Job{Kind: JobRefresh})
+	}
+
+	return jobs, nil
+}
+
+// memberRow returns a new row of the coub in the timeline table of this kind.
+// seenAt is set explicitly, it's compared with the app clock by markRemoved.
+func memberRow(kind JobKind, target string, coub *coubs.Coub, rawCoub json.RawMessage, seenAt time.Time) interface{} {
+	switch kind {
+	case JobProfile:
+		return &ProfileCoub{
+			Profile:     target,
+			CoubID:      coub.ID,
+			PublishedAt: coub.PublishedAt,
+			Info:        rawCoub,
+			LastSeenAt:  &seenAt,
+		}
+	case JobLikes:
+		return &LikedCoub{
+			Profile:    target,
+			CoubID:     coub.ID,
+			Info:       rawCoub,
+			LastSeenAt: &seenAt,
+		}
+	case JobFavorites:
+		return &FavoriteCoub{
+			Profile:    target,
+			CoubID:     coub.ID,
+			Info:       rawCoub,
+			LastSeenAt: &seenAt,
+		}
+	default:
+		return nil
+	}
+}
+
+// memberModel returns the table with coubs of the timeline of this kind.
+func memberModel(kind JobKind) interface{} {
+	switch kind {
+	case JobProfile:
+		return &ProfileCoub{}
+	case JobLikes:
+		return &LikedCoub{}
+	case JobFavorites:
+		return &FavoriteCoub{}
+	default:
+		return nil
+	}
+}
+
+// Run runs the job and tracks its progress.
+func (b *Backup) Run(ctx context.Context, job Job) error {
+	progress := b.tracker.Start(job)
+	err := b.run(withProgress(ctx, progress), job)
+	progress.Finish(err)
+	return err
+}
+
+func (b *Backup) run(ctx context.Context, job Job) error {
+	switch job.Kind {
+	case JobProfile:
+		return b.profile(ctx, job)
+	case JobLikes:
+		return b.likes(ctx, job)
+	case JobFavorites:
+		return b.favorites(ctx, job)
+	case JobTimeline:
+		return b.timeline(ctx, job)
+	case JobVerify:
+		return b.Verify(ctx)
+	case JobRefresh:
+		return b.Refresh(ctx)
+	default:
+		return fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+}
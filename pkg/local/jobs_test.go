@@ -0,0 +1,98 @@
+package local
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/rwlist/coub/pkg/conf"
+	"github.com/rwlist/coub/pkg/coubs"
+)
+
+// staticSession never changes, cookie updates are ignored.
+type staticSession struct{}
+
+func (staticSession) Get() (*coubs.State, error) {
+	return coubs.ParseState("GET /api/v2/timeline HTTP/1.1\r\nHost: coub.com")
+}
+
+func (staticSession) Update(*http.Response) error {
+	return nil
+}
+
+func TestJobsTimelines(t *testing.T) {
+	cfg := &conf.App{
+		BackupMode:      string(ModeIncremental),
+		BackupTimelines: []string{"hot", "tag:cats"},
+	}
+	jobs, err := Jobs(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Job{
+		{Kind: JobTimeline, Target: "hot", Mode: ModeFull},
+		{Kind: JobTimeline, Target: "tag:cats", Mode: ModeFull},
+	}
+	if !reflect.DeepEqual(jobs, want) {
+		t.Errorf("jobs = %v, want %v", jobs, want)
+	}
+
+	cfg.BackupTimelines = []string{"tag:cats", "trending"}
+	if _, err := Jobs(cfg); err == nil {
+		t.Error("expected an error for unknown timeline")
+	}
+}
+
+func TestTimelineFetch(t *testing.T) {
+	tests := map[string]string{
+		"hot":                      "/timeline/hot",
+		"featured":                 "/timeline/featured",
+		"tag:cats":                 "/timeline/tag/cats",
+		"community:animals-pets":   "/timeline/community/animals-pets/fresh",
+		"community:memes/monthly":  "/timeline/community/memes/monthly",
+		"search:cats":              "/search/coubs",
+		"search:cats:dogs":         "/search/coubs",
+		"":                         "",
+		"trending":                 "",
+		"tag":                      "",
+		"tag:":                     "",
+		"community:":               "",
+		"search:":                  "",
+		"hot:cats":                 "",
+		"featured:memes/featured/": "",
+	}
+
+	paths := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"page":1,"total_pages":1,"coubs":[]}`))
+	}))
+	defer server.Close()
+	client := coubs.NewClient(staticSession{}, coubs.WithBaseURL(server.URL))
+
+	for timeline, wantPath := range tests {
+		fetch, err := timelineFetch(client, timeline)
+		if wantPath == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error", timeline)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", timeline, err)
+			continue
+		}
+
+		if _, err := fetch(context.Background(), 1); err != nil {
+			t.Errorf("%q: fetch: %v", timeline, err)
+			continue
+		}
+		if gotPath := <-paths; gotPath != wantPath {
+			t.Errorf("%q: path %s, want %s", timeline, gotPath, wantPath)
+		}
+	}
+}
@@ -11,6 +11,10 @@ func AutoMigrate(db *gorm.DB) error {
 		&SavedCoub{},
 		&ProfileCoub{},
 		&LikedCoub{},
+		&FavoriteCoub{},
+		&FailedDownload{},
+		&Checkpoint{},
+		&CoubStats{},
 	)
 }
 
@@ -20,19 +24,79 @@ type SavedCoub struct {
 	UpdatedAt time.Time
 	Info      []byte `gorm:"type:jsonb;not null"`
 	NoAudio   bool   `gorm:"not null"`
+
+	// UpstreamStatus is the status of the coub on Coub, see Backup.Verify.
+	UpstreamStatus    string `gorm:"not null;default:unknown;index"`
+	UpstreamCheckedAt *time.Time
+	UpstreamChangedAt *time.Time
+	// RefreshedAt is the time of the last metadata update, see Backup.Refresh.
+	RefreshedAt *time.Time
 }
 
 type ProfileCoub struct {
 	gorm.Model
-	Profile     string    `gorm:"not null;index:idx_prof_coub,unique"`
-	CoubID      int       `gorm:"not null;index:idx_prof_coub,unique"`
-	PublishedAt time.Time `gorm:"not null"`
-	Info        []byte    `gorm:"type:jsonb;not null"`
+	Profile     string     `gorm:"not null;index:idx_prof_coub,unique"`
+	CoubID      int        `gorm:"not null;index:idx_prof_coub,unique"`
+	PublishedAt time.Time  `gorm:"not null"`
+	Info        []byte     `gorm:"type:jsonb;not null"`
+	LastSeenAt  *time.Time `gorm:"default:now()"`
+	RemovedAt   *time.Time `gorm:"index"`
 }
 
 type LikedCoub struct {
 	gorm.Model
-	Profile string `gorm:"not null;index:idx_liked_coub,unique"`
-	CoubID  int    `gorm:"not null;index:idx_liked_coub,unique"`
-	Info    []byte `gorm:"type:jsonb;not null"`
+	Profile    string     `gorm:"not null;index:idx_liked_coub,unique"`
+	CoubID     int        `gorm:"not null;index:idx_liked_coub,unique"`
+	Info       []byte     `gorm:"type:jsonb;not null"`
+	LastSeenAt *time.Time `gorm:"default:now()"`
+	RemovedAt  *time.Time `gorm:"index"`
+}
+
+type FavoriteCoub struct {
+	gorm.Model
+	Profile    string     `gorm:"not null;index:idx_favorite_coub,unique"`
+	CoubID     int        `gorm:"not null;index:idx_favorite_coub,unique"`
+	Info       []byte     `gorm:"type:jsonb;not null"`
+	LastSeenAt *time.Time `gorm:"default:now()"`
+	RemovedAt  *time.Time `gorm:"index"`
+}
+
+// FailedDownload is a queue of coubs that failed to download.
+type FailedDownload struct {
+	CoubID      int `gorm:"primarykey"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Stage       string    `gorm:"not null"`
+	Error       string    `gorm:"not null"`
+	Attempts    int       `gorm:"not null"`
+	NextRetryAt time.Time `gorm:"not null;index"`
+	Info        []byte    `gorm:"type:jsonb;not null"`
+	// Timelines are the timelines the coub is added to, once it's
+	// downloaded, see Downloader.resolveFailure.
+	Timelines []byte `gorm:"type:jsonb"`
+}
+
+// Checkpoint is the progress of the backup job, see Backup.startPage.
+type Checkpoint struct {
+	Kind      string `gorm:"primarykey"`
+	Target    string `gorm:"primarykey"`
+	UpdatedAt time.Time
+	// Page is the last fully processed page.
+	Page int `gorm:"not null"`
+	// CoubID is the last coub of the page.
+	CoubID    int  `gorm:"not null"`
+	Completed bool `gorm:"not null"`
+	// StartedAt is the start of the run, that began from the first page.
+	StartedAt time.Time
+}
+
+// CoubStats is a snapshot of coub statistics, taken by Backup.Refresh.
+type CoubStats struct {
+	ID           uint      `gorm:"primarykey"`
+	CoubID       int       `gorm:"not null;index:idx_coub_stats"`
+	CreatedAt    time.Time `gorm:"index:idx_coub_stats"`
+	ViewsCount   int       `gorm:"not null"`
+	LikesCount   int       `gorm:"not null"`
+	RecoubsCount int       `gorm:"not null"`
+	RemixesCount int       `gorm:"not null"`
 }
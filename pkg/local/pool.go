@@ -0,0 +1,267 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/rwlist/coub/pkg/coubs"
+	"github.com/rwlist/coub/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// timelineItem is a coub taken from a timeline and passed through the pool.
+type timelineItem struct {
+	Page       int
+	Index      int
+	LastInPage bool
+	Raw        json.RawMessage
+	Coub       coubs.Coub
+	// Err is the result of the download, it's set before done is closed.
+	Err  error
+	done chan struct{}
+}
+
+// errCaughtUp stops an incremental backup that reached archived coubs.
+var errCaughtUp = errors.New("reached archived coubs")
+
+// archive downloads coubs from the timeline with a pool of b.workers workers.
+// save is called from the calling goroutine for every coub, strictly in
+// the timeline order, after its download is finished. It returns true if
+// the coub has been archived before.
+//
+// Full job is resumed from its checkpoint, which is updated after every
+// processed page. Incremental job starts from the first page and stops after
+// b.stopAfter consecutive archived coubs.
+//
+// When ctx is cancelled, no new coubs are taken from the timeline, but the
+// started downloads are finished and saved within the shutdown grace period.
+func (b *Backup) archive(
+	ctx context.Context,
+	job Job,
+	fetch coubs.PageFunc,
+	save func(ctx context.Context, item *timelineItem) (bool, error),
+) error {
+	checkpoint, err := b.loadCheckpoint(ctx, job)
+	if err != nil {
+		return err
+	}
+
+	run := &archiveRun{
+		backup:     b,
+		job:        job,
+		checkpoint: checkpoint,
+		progress:   progressFrom(ctx),
+		save:       save,
+	}
+	it := coubs.NewIterator(withPauses(fetch), checkpoint.startPage())
+
+	workCtx, cancelWork := b.downloader.graceful(ctx)
+	defer cancelWork()
+	poolCtx, cancel := context.WithCancel(workCtx)
+	defer cancel()
+
+	// feedCtx stops the timeline as soon as ctx is cancelled
+	feedCtx, cancelFeed := context.WithCancel(poolCtx)
+	defer cancelFeed()
+	stopFeed := context.AfterFunc(ctx, cancelFeed)
+	defer stopFeed()
+
+	workers := b.workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan *timelineItem)
+	// ordered is bounded, so the iterator stays at most a few coubs ahead
+	ordered := make(chan *timelineItem, workers)
+
+	go run.produce(feedCtx, poolCtx, it, jobs, ordered)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			run.download(poolCtx, worker, jobs)
+		}(worker)
+	}
+
+	err = b.saveInOrder(poolCtx, ordered, run.saveItem)
+	cancel()
+	wg.Wait()
+	return run.finish(ctx, err)
+}
+
+// archiveRun is the state of a single archive call.
+type archiveRun struct {
+	backup     *Backup
+	job        Job
+	checkpoint *Checkpoint
+	progress   *JobProgress
+	save       func(ctx context.Context, item *timelineItem) (bool, error)
+
+	// set by produce before ordered is closed
+	iterErr  error
+	complete bool
+
+	// updated by saveItem
+	streak int
+	seen   int
+}
+
+// produce walks the timeline until feedCtx is done, queueing every coub for
+// download and then passing it to ordered. A queued coub is passed to ordered
+// even if feedCtx is done in between, so that it's saved after the download.
+// Both channels are closed when it returns.
+func (r *archiveRun) produce(feedCtx, poolCtx context.Context, it *coubs.Iterator, jobs, ordered chan<- *timelineItem) {
+	defer close(jobs)
+	defer close(ordered)
+
+	for it.Next(feedCtx) {
+		if it.Index() == 0 {
+			r.progress.Page(it.Page(), it.TotalPages(), it.Response().PerPage)
+		}
+
+		item := &timelineItem{
+			Page:       it.Page(),
+			Index:      it.Index(),
+			LastInPage: it.LastInPage(),
+			Raw:        it.Coub(),
+			done:       make(chan struct{}),
+		}
+		item.Err = json.Unmarshal(item.Raw, &item.Coub)
+
+		// the item is queued for download first, so that every item in
+		// ordered is eventually done
+		if item.Err != nil {
+			close(item.done)
+		} else {
+			select {
+			case jobs <- item:
+			case <-feedCtx.Done():
+				return
+			}
+		}
+		select {
+		case ordered <- item:
+		case <-poolCtx.Done():
+			return
+		}
+	}
+	r.iterErr = it.Err()
+	r.complete = it.Complete()
+}
+
+func (r *archiveRun) download(ctx context.Context, worker int, jobs <-chan *timelineItem) {
+	defer r.progress.WorkerIdle(worker)
+
+	for item := range jobs {
+		r.progress.WorkerBusy(worker, item)
+		item.Err = r.backup.downloader.DownloadCoub(ctx, item.Raw)
+		close(item.done)
+	}
+}
+
+// saveItem saves a downloaded item and the checkpoint, or stops an
+// incremental job with errCaughtUp.
+func (r *archiveRun) saveItem(ctx context.Context, item *timelineItem) error {
+	known, err := r.save(ctx, item)
+	if err != nil {
+		return err
+	}
+	r.seen++
+
+	result := metrics.ResultArchived
+	switch {
+	case item.Err != nil:
+		result = metrics.ResultFailed
+		r.progress.CoubFailed()
+	case known:
+		result = metrics.ResultSkipped
+		r.progress.CoubSkipped()
+	default:
+		r.progress.CoubDone()
+	}
+	metrics.Coubs.WithLabelValues(string(r.job.Kind), r.job.Target, result).Inc()
+
+	if r.job.Mode == ModeIncremental {
+		r.streak++
+		if !known {
+			r.streak = 0
+		}
+		if known && r.streak >= r.backup.stopAfter {
+			return errCaughtUp
+		}
+		return nil
+	}
+
+	if !item.LastInPage {
+		return nil
+	}
+	r.checkpoint.Page = item.Page
+	r.checkpoint.CoubID = item.Coub.ID
+	return r.backup.saveCheckpoint(ctx, r.checkpoint)
+}
+
+// finish completes the job after all items are saved, err is the result
+// of saving. ordered must be already closed.
+func (r *archiveRun) finish(ctx context.Context, err error) error {
+	if errors.Is(err, errCaughtUp) {
+		log.WithField("job", r.job.String()).WithField("streak", r.streak).Info("Incremental backup reached archived coubs")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		// interrupted, the checkpoint points to the last processed page
+		return ctx.Err()
+	}
+	if r.iterErr != nil || r.job.Mode == ModeIncremental {
+		return r.iterErr
+	}
+
+	// an empty page in the middle of the timeline is likely an API glitch,
+	// coubs on the next pages are not removed, and the job is resumed from
+	// the checkpoint next time
+	if !r.complete {
+		return fmt.Errorf("timeline ended before the last page, last processed page %d", r.checkpoint.Page)
+	}
+
+	// the whole timeline was seen since checkpoint.StartedAt, but don't trust
+	// an empty timeline, it's more likely an API glitch
+	if r.seen > 0 {
+		err = r.backup.markRemoved(ctx, r.job, r.checkpoint.StartedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.checkpoint.Page = 0
+	r.checkpoint.CoubID = 0
+	r.checkpoint.Completed = true
+	return r.backup.saveCheckpoint(ctx, r.checkpoint)
+}
+
+func (b *Backup) saveInOrder(
+	ctx context.Context,
+	ordered <-chan *timelineItem,
+	save func(ctx context.Context, item *timelineItem) error,
+) error {
+	for item := range ordered {
+		select {
+		case <-item.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		err := save(ctx, item)
+		if err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
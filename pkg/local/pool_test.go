@@ -0,0 +1,321 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rwlist/coub/pkg/coubs"
+)
+
+var errTest = errors.New("test error")
+
+// fakeTimeline serves pages of coub ids, pages[0] is page 1. Fetching
+// errPage fails with errTest.
+func fakeTimeline(errPage int, pages ...[]int) coubs.PageFunc {
+	return func(_ context.Context, page int) (*coubs.PageResponse, error) {
+		if page == errPage {
+			return nil, errTest
+		}
+
+		res := &coubs.PageResponse{Page: page, PerPage: 2, TotalPages: len(pages)}
+		if page <= len(pages) {
+			for _, id := range pages[page-1] {
+				res.Coubs = append(res.Coubs, json.RawMessage(fmt.Sprintf(`{"id":%d}`, id)))
+			}
+		}
+		return res, nil
+	}
+}
+
+// doneItems returns downloaded items with the given ids, all on the first page.
+func doneItems(ids ...int) []*timelineItem {
+	items := make([]*timelineItem, len(ids))
+	for i, id := range ids {
+		items[i] = &timelineItem{
+			Page:  1,
+			Index: i,
+			Coub:  coubs.Coub{ID: id},
+			done:  make(chan struct{}),
+		}
+		close(items[i].done)
+	}
+	return items
+}
+
+func orderedOf(items []*timelineItem) <-chan *timelineItem {
+	ordered := make(chan *timelineItem, len(items))
+	for _, item := range items {
+		ordered <- item
+	}
+	close(ordered)
+	return ordered
+}
+
+// produceAll runs produce with a single fake worker, and returns ids of
+// coubs passed to ordered, checking that every coub is downloaded first.
+func produceAll(t *testing.T, run *archiveRun, fetch coubs.PageFunc) []int {
+	t.Helper()
+
+	ctx := context.Background()
+	jobs := make(chan *timelineItem)
+	ordered := make(chan *timelineItem, 2)
+	go run.produce(ctx, ctx, coubs.NewIterator(fetch, 1), jobs, ordered)
+	go func() {
+		for item := range jobs {
+			close(item.done)
+		}
+	}()
+
+	var ids []int
+	for item := range ordered {
+		<-item.done
+		ids = append(ids, item.Coub.ID)
+	}
+	return ids
+}
+
+func TestProduce(t *testing.T) {
+	run := &archiveRun{}
+	ids := produceAll(t, run, fakeTimeline(0, []int{1, 2}, []int{3, 4}, []int{5}))
+
+	if want := []int{1, 2, 3, 4, 5}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("ids = %v, want %v", ids, want)
+	}
+	if run.iterErr != nil || !run.complete {
+		t.Errorf("iterErr = %v, complete = %v", run.iterErr, run.complete)
+	}
+}
+
+func TestProduceError(t *testing.T) {
+	run := &archiveRun{}
+	ids := produceAll(t, run, fakeTimeline(2, []int{1, 2}, []int{3, 4}, []int{5}))
+
+	if want := []int{1, 2}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("ids = %v, want %v", ids, want)
+	}
+	if !errors.Is(run.iterErr, errTest) || run.complete {
+		t.Errorf("iterErr = %v, complete = %v", run.iterErr, run.complete)
+	}
+}
+
+func TestProduceBrokenCoub(t *testing.T) {
+	fetch := func(_ context.Context, page int) (*coubs.PageResponse, error) {
+		return &coubs.PageResponse{
+			Page:       page,
+			TotalPages: 1,
+			Coubs:      []json.RawMessage{json.RawMessage(`{"id":1}`), json.RawMessage(`[]`)},
+		}, nil
+	}
+
+	ctx := context.Background()
+	jobs := make(chan *timelineItem, 2)
+	ordered := make(chan *timelineItem, 2)
+	(&archiveRun{}).produce(ctx, ctx, coubs.NewIterator(fetch, 1), jobs, ordered)
+
+	if len(jobs) != 1 || len(ordered) != 2 {
+		t.Fatalf("%d coubs queued and %d ordered, want 1 and 2", len(jobs), len(ordered))
+	}
+	<-ordered
+	broken := <-ordered
+	select {
+	case <-broken.done:
+	default:
+		t.Error("broken coub is not done")
+	}
+	if broken.Err == nil || !broken.LastInPage {
+		t.Errorf("broken coub err = %v, last in page = %v", broken.Err, broken.LastInPage)
+	}
+}
+
+// TestProduceFeedCancelled checks that a coub queued for download is saved,
+// even if the feed is stopped right after queueing it.
+func TestProduceFeedCancelled(t *testing.T) {
+	feedCtx, cancelFeed := context.WithCancel(context.Background())
+	defer cancelFeed()
+
+	jobs := make(chan *timelineItem)
+	ordered := make(chan *timelineItem)
+	fetch := fakeTimeline(0, []int{1, 2}, []int{3, 4})
+	go (&archiveRun{}).produce(feedCtx, context.Background(), coubs.NewIterator(fetch, 1), jobs, ordered)
+
+	// the feed is stopped while the first coub is downloaded, before
+	// anyone reads ordered
+	item := <-jobs
+	cancelFeed()
+	close(item.done)
+
+	var saved []int
+	for item := range ordered {
+		saved = append(saved, item.Coub.ID)
+	}
+	if want := []int{1}; !reflect.DeepEqual(saved, want) {
+		t.Errorf("saved %v, want %v", saved, want)
+	}
+	if _, ok := <-jobs; ok {
+		t.Error("coubs are queued after the feed is stopped")
+	}
+}
+
+func TestSaveInOrder(t *testing.T) {
+	items := make([]*timelineItem, 5)
+	for i := range items {
+		items[i] = &timelineItem{Coub: coubs.Coub{ID: i + 1}, done: make(chan struct{})}
+	}
+	// downloads finish in reverse order
+	go func() {
+		for i := len(items) - 1; i >= 0; i-- {
+			close(items[i].done)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	var saved []int
+	err := (&Backup{}).saveInOrder(context.Background(), orderedOf(items), func(_ context.Context, item *timelineItem) error {
+		saved = append(saved, item.Coub.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1, 2, 3, 4, 5}; !reflect.DeepEqual(saved, want) {
+		t.Errorf("saved %v, want %v", saved, want)
+	}
+}
+
+func TestSaveInOrderError(t *testing.T) {
+	var saved []int
+	err := (&Backup{}).saveInOrder(context.Background(), orderedOf(doneItems(1, 2, 3)), func(_ context.Context, item *timelineItem) error {
+		saved = append(saved, item.Coub.ID)
+		if item.Coub.ID == 2 {
+			return errTest
+		}
+		return nil
+	})
+	if !errors.Is(err, errTest) {
+		t.Errorf("err = %v, want %v", err, errTest)
+	}
+	if want := []int{1, 2}; !reflect.DeepEqual(saved, want) {
+		t.Errorf("saved %v, want %v", saved, want)
+	}
+}
+
+func TestSaveInOrderCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// the download of the second coub never finishes
+	items := append(doneItems(1), &timelineItem{Coub: coubs.Coub{ID: 2}, done: make(chan struct{})})
+
+	var saved []int
+	err := (&Backup{}).saveInOrder(ctx, orderedOf(items), func(_ context.Context, item *timelineItem) error {
+		saved = append(saved, item.Coub.ID)
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want deadline exceeded", err)
+	}
+	if want := []int{1}; !reflect.DeepEqual(saved, want) {
+		t.Errorf("saved %v, want %v", saved, want)
+	}
+}
+
+func TestIncrementalStop(t *testing.T) {
+	tests := []struct {
+		name      string
+		known     []bool
+		stopAfter int
+		wantSaved int
+		wantErr   error
+	}{
+		{name: "nothing archived", known: []bool{false, false, false}, stopAfter: 2, wantSaved: 3},
+		{name: "stops after streak", known: []bool{false, true, true, true}, stopAfter: 2, wantSaved: 3, wantErr: errCaughtUp},
+		{name: "streak is reset", known: []bool{true, false, true, false, true, true}, stopAfter: 2, wantSaved: 6, wantErr: errCaughtUp},
+		{name: "streak too short", known: []bool{true, true, false}, stopAfter: 3, wantSaved: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids := make([]int, len(tt.known))
+			for i := range ids {
+				ids[i] = i + 1
+			}
+			items := doneItems(ids...)
+
+			saved := 0
+			run := &archiveRun{
+				backup: &Backup{stopAfter: tt.stopAfter},
+				job:    Job{Kind: JobProfile, Target: "test", Mode: ModeIncremental},
+				save: func(_ context.Context, item *timelineItem) (bool, error) {
+					saved++
+					return tt.known[item.Index], nil
+				},
+			}
+
+			err := run.backup.saveInOrder(context.Background(), orderedOf(items), run.saveItem)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if saved != tt.wantSaved {
+				t.Errorf("saved %d coubs, want %d", saved, tt.wantSaved)
+			}
+			if err := run.finish(context.Background(), err); err != nil {
+				t.Errorf("finish: %v", err)
+			}
+		})
+	}
+}
+
+func TestFinish(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		mode     Mode
+		saveErr  error
+		iterErr  error
+		complete bool
+		wantErr  error
+		wantAny  bool
+	}{
+		{name: "caught up", mode: ModeIncremental, saveErr: errCaughtUp},
+		{name: "save failed", mode: ModeFull, saveErr: errTest, complete: true, wantErr: errTest},
+		{name: "interrupted", ctx: cancelled, mode: ModeFull, complete: true, wantErr: context.Canceled},
+		{name: "timeline failed", mode: ModeFull, iterErr: errTest, wantErr: errTest},
+		{name: "incremental timeline failed", mode: ModeIncremental, iterErr: errTest, wantErr: errTest},
+		{name: "incremental reached the end", mode: ModeIncremental, complete: true},
+		{name: "ended before the last page", mode: ModeFull, wantAny: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			run := &archiveRun{
+				job:        Job{Kind: JobProfile, Target: "test", Mode: tt.mode},
+				checkpoint: &Checkpoint{Page: 3},
+				iterErr:    tt.iterErr,
+				complete:   tt.complete,
+			}
+
+			err := run.finish(ctx, tt.saveErr)
+			if tt.wantAny {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package local
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job states, saved in JobStatus.State.
+const (
+	JobRunning  = "running"
+	JobFinished = "finished"
+	JobFailed   = "failed"
+)
+
+type WorkerStatus struct {
+	Worker    int       `json:"worker"`
+	CoubID    int       `json:"coub_id"`
+	Title     string    `json:"title"`
+	Page      int       `json:"page"`
+	Index     int       `json:"index"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// JobStatus is a snapshot of the progress of a single job.
+type JobStatus struct {
+	ID         int64          `json:"id"`
+	Kind       JobKind        `json:"kind"`
+	Target     string         `json:"target,omitempty"`
+	Mode       Mode           `json:"mode,omitempty"`
+	State      string         `json:"state"`
+	Page       int            `json:"page"`
+	TotalPages int            `json:"total_pages"`
+	Done       int            `json:"done"`
+	Skipped    int            `json:"skipped"`
+	Failed     int            `json:"failed"`
+	Bytes      int64          `json:"bytes"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+	ETA        *time.Time     `json:"eta,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	Workers    []WorkerStatus `json:"workers,omitempty"`
+}
+
+// Tracker is a registry of running jobs and a bounded history of finished ones.
+type Tracker struct {
+	mux         sync.Mutex
+	nextID      int64
+	running     map[int64]*JobProgress
+	history     []JobStatus
+	historySize int
+	subscribers map[chan struct{}]struct{}
+}
+
+func NewTracker(historySize int) *Tracker {
+	if historySize < 0 {
+		historySize = 0
+	}
+	return &Tracker{
+		running:     map[int64]*JobProgress{},
+		historySize: historySize,
+		subscribers: map[chan struct{}]struct{}{},
+	}
+}
+
+// Subscribe returns a channel that receives a value when any job changes.
+// Changes are coalesced, a slow reader gets a single notification for all
+// changes since its last read. unsubscribe must be called when done.
+func (t *Tracker) Subscribe() (changed <-chan struct{}, unsubscribe func()) {
+	ch := make(chan struct{}, 1)
+
+	t.mux.Lock()
+	t.subscribers[ch] = struct{}{}
+	t.mux.Unlock()
+
+	return ch, func() {
+		t.mux.Lock()
+		delete(t.subscribers, ch)
+		t.mux.Unlock()
+	}
+}
+
+// notify must be called with t.mux held.
+func (t *Tracker) notify() {
+	for ch := range t.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// JobProgress reports the progress of a running job. All methods are safe
+// to call on nil progress, they do nothing then.
+type JobProgress struct {
+	tracker *Tracker
+	status  JobStatus
+	workers map[int]WorkerStatus
+
+	// for ETA estimation
+	firstPage int
+	perPage   int
+}
+
+func (t *Tracker) Start(job Job) *JobProgress {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.nextID++
+	p := &JobProgress{
+		tracker: t,
+		status: JobStatus{
+			ID:        t.nextID,
+			Kind:      job.Kind,
+			Target:    job.Target,
+			Mode:      job.Mode,
+			State:     JobRunning,
+			StartedAt: time.Now(),
+		},
+		workers: map[int]WorkerStatus{},
+	}
+	t.running[p.status.ID] = p
+	t.notify()
+	return p
+}
+
+// Jobs returns running jobs followed by finished ones, newest first.
+func (t *Tracker) Jobs() []JobStatus {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	res := make([]JobStatus, 0, len(t.running)+len(t.history))
+	for _, p := range t.running {
+		res = append(res, p.snapshot())
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID > res[j].ID
+	})
+	for i := len(t.history) - 1; i >= 0; i-- {
+		res = append(res, t.history[i])
+	}
+	return res
+}
+
+// snapshot must be called with tracker.mux held.
+func (p *JobProgress) snapshot() JobStatus {
+	status := p.status
+	status.Workers = make([]WorkerStatus, 0, len(p.workers))
+	for _, worker := range p.workers {
+		status.Workers = append(status.Workers, worker)
+	}
+	sort.Slice(status.Workers, func(i, j int) bool {
+		return status.Workers[i].Worker < status.Workers[j].Worker
+	})
+
+	if status.State == JobRunning {
+		status.ETA = p.eta()
+	}
+	return status
+}
+
+// eta extrapolates the time spent on processed coubs to the rest of pages.
+func (p *JobProgress) eta() *time.Time {
+	processed := p.status.Done + p.status.Skipped + p.status.Failed
+	total := (p.status.TotalPages - p.firstPage + 1) * p.perPage
+	if processed == 0 || total <= processed {
+		return nil
+	}
+
+	elapsed := time.Since(p.status.StartedAt)
+	left := time.Duration(float64(elapsed) / float64(processed) * float64(total-processed))
+	eta := time.Now().Add(left)
+	return &eta
+}
+
+func (p *JobProgress) update(fn func()) {
+	if p == nil {
+		return
+	}
+	p.tracker.mux.Lock()
+	defer p.tracker.mux.Unlock()
+	fn()
+	p.tracker.notify()
+}
+
+func (p *JobProgress) Page(page, totalPages, perPage int) {
+	p.update(func() {
+		if p.firstPage == 0 {
+			p.firstPage = page
+		}
+		p.perPage = perPage
+		p.status.Page = page
+		p.status.TotalPages = totalPages
+	})
+}
+
+func (p *JobProgress) CoubDone() {
+	p.update(func() { p.status.Done++ })
+}
+
+func (p *JobProgress) CoubSkipped() {
+	p.update(func() { p.status.Skipped++ })
+}
+
+func (p *JobProgress) CoubFailed() {
+	p.update(func() { p.status.Failed++ })
+}
+
+func (p *JobProgress) AddBytes(n int64) {
+	p.update(func() { p.status.Bytes += n })
+}
+
+func (p *JobProgress) WorkerBusy(worker int, item *timelineItem) {
+	p.update(func() {
+		p.workers[worker] = WorkerStatus{
+			Worker:    worker,
+			CoubID:    item.Coub.ID,
+			Title:     item.Coub.Title,
+			Page:      item.Page,
+			Index:     item.Index,
+			StartedAt: time.Now(),
+		}
+	})
+}
+
+func (p *JobProgress) WorkerIdle(worker int) {
+	p.update(func() { delete(p.workers, worker) })
+}
+
+// Finish moves the job to the history.
+func (p *JobProgress) Finish(err error) {
+	p.update(func() {
+		now := time.Now()
+		p.status.FinishedAt = &now
+		p.status.State = JobFinished
+		if err != nil {
+			p.status.State = JobFailed
+			p.status.Error = err.Error()
+		}
+		p.workers = map[int]WorkerStatus{}
+
+		t := p.tracker
+		delete(t.running, p.status.ID)
+		t.history = append(t.history, p.snapshot())
+		if len(t.history) > t.historySize {
+			t.history = t.history[len(t.history)-t.historySize:]
+		}
+	})
+}
+
+type progressKey struct{}
+
+// withProgress attaches the progress to ctx, so that downloads deep in
+// the call stack can report transferred bytes.
+func withProgress(ctx context.Context, p *JobProgress) context.Context {
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+// progressFrom returns the progress attached to ctx, or nil.
+func progressFrom(ctx context.Context) *JobProgress {
+	p, _ := ctx.Value(progressKey{}).(*JobProgress)
+	return p
+}
@@ -0,0 +1,60 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/rwlist/coub/pkg/coubs"
+	"gorm.io/gorm"
+)
+
+// Refresh fetches current metadata of archived coubs, updates SavedCoub.Info
+// and appends a CoubStats snapshot. Coubs refreshed less than b.refreshAge
+// ago are skipped. Upstream status is updated as well, see Verify.
+func (b *Backup) Refresh(ctx context.Context) error {
+	session := &sessionCheck{client: b.client}
+	return b.walkSaved(ctx, "refreshed_at", b.refreshAge, func(saved *SavedCoub) error {
+		status, rawCoub, err := b.checkUpstream(ctx, session, saved)
+		if err != nil {
+			return err
+		}
+
+		err = b.saveUpstreamStatus(ctx, saved, status)
+		if err != nil {
+			return err
+		}
+		if status != UpstreamAlive {
+			// keep the last known metadata of lost coubs
+			return b.db.WithContext(ctx).Model(&SavedCoub{}).
+				Where("coub_id = ?", saved.CoubID).
+				Update("refreshed_at", time.Now()).Error
+		}
+
+		var coub coubs.Coub
+		err = json.Unmarshal(rawCoub, &coub)
+		if err != nil {
+			return err
+		}
+
+		return b.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			err := tx.Model(&SavedCoub{}).
+				Where("coub_id = ?", saved.CoubID).
+				Updates(map[string]interface{}{
+					"info":         []byte(rawCoub),
+					"refreshed_at": time.Now(),
+				}).Error
+			if err != nil {
+				return err
+			}
+
+			return tx.Create(&CoubStats{
+				CoubID:       saved.CoubID,
+				ViewsCount:   coub.ViewsCount,
+				LikesCount:   coub.LikesCount,
+				RecoubsCount: coub.RecoubsCount,
+				RemixesCount: coub.RemixesCount,
+			}).Error
+		})
+	})
+}
@@ -0,0 +1,238 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rwlist/coub/pkg/conf"
+	log "github.com/sirupsen/logrus"
+)
+
+// Schedule runs the job every Interval. Zero interval runs the job once.
+type Schedule struct {
+	Job      Job
+	Interval time.Duration
+	// FullInterval makes an incremental job run in full mode, if the last
+	// full run was completed earlier than FullInterval ago.
+	FullInterval time.Duration
+}
+
+// Schedules returns schedules for all jobs from the config. BACKUP_INTERVALS
+// overrides BACKUP_INTERVAL for all jobs of a kind ("likes=6h") or for
+// a single job ("profile:name=24h").
+func Schedules(cfg *conf.App) ([]Schedule, error) {
+	jobs, err := Jobs(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	intervals := map[string]time.Duration{}
+	for _, entry := range cfg.BackupIntervals {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid backup interval %q, expected key=duration", entry)
+		}
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backup interval %q: %w", entry, err)
+		}
+		intervals[key] = interval
+	}
+
+	schedules := make([]Schedule, 0, len(jobs))
+	for _, job := range jobs {
+		interval := cfg.BackupInterval
+		if override, ok := intervals[string(job.Kind)]; ok {
+			interval = override
+		}
+		if override, ok := intervals[job.String()]; ok {
+			interval = override
+		}
+
+		schedules = append(schedules, Schedule{
+			Job:          job,
+			Interval:     interval,
+			FullInterval: cfg.BackupFullInterval,
+		})
+	}
+	return schedules, nil
+}
+
+// mode returns the mode of the next run, given the time of the last
+// completed full run, which is zero if there was none.
+func (s Schedule) mode(lastFull, now time.Time) Mode {
+	if s.Job.Mode == ModeIncremental && s.FullInterval > 0 && now.Sub(lastFull) > s.FullInterval {
+		return ModeFull
+	}
+	return s.Job.Mode
+}
+
+type ScheduleStatus struct {
+	Job       string     `json:"job"`
+	Mode      Mode       `json:"mode"`
+	Interval  string     `json:"interval"`
+	Running   bool       `json:"running"`
+	LastStart *time.Time `json:"last_start,omitempty"`
+	LastEnd   *time.Time `json:"last_end,omitempty"`
+	LastMode  Mode       `json:"last_mode,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	NextRun   *time.Time `json:"next_run,omitempty"`
+}
+
+// Scheduler runs backup jobs periodically. The same job is never run twice
+// at once, even if it has several schedules.
+type Scheduler struct {
+	backup    *Backup
+	schedules []Schedule
+
+	mux     sync.Mutex
+	status  []ScheduleStatus
+	running map[string]bool
+}
+
+func NewScheduler(backup *Backup, schedules []Schedule) *Scheduler {
+	status := make([]ScheduleStatus, len(schedules))
+	for i, schedule := range schedules {
+		status[i] = ScheduleStatus{
+			Job:      schedule.Job.String(),
+			Mode:     schedule.Job.Mode,
+			Interval: schedule.Interval.String(),
+		}
+	}
+
+	return &Scheduler{
+		backup:    backup,
+		schedules: schedules,
+		status:    status,
+		running:   map[string]bool{},
+	}
+}
+
+// Run starts all schedules and blocks until ctx is done and all running jobs
+// are finished.
+func (s *Scheduler) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := range s.schedules {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.loop(ctx, i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (s *Scheduler) Status() []ScheduleStatus {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	res := make([]ScheduleStatus, len(s.status))
+	copy(res, s.status)
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Job < res[j].Job
+	})
+	return res
+}
+
+func (s *Scheduler) loop(ctx context.Context, index int) {
+	schedule := s.schedules[index]
+
+	for {
+		s.runOnce(ctx, index)
+		if schedule.Interval <= 0 || ctx.Err() != nil {
+			return
+		}
+
+		next := time.Now().Add(schedule.Interval)
+		s.updateStatus(index, func(status *ScheduleStatus) {
+			status.NextRun = &next
+		})
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (s *Scheduler) runOnce(ctx context.Context, index int) {
+	schedule := s.schedules[index]
+	job := schedule.Job
+	logger := log.WithField("job", job.String())
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	if !s.lock(job) {
+		logger.Warn("Backup job is already running, skipping")
+		return
+	}
+	defer s.unlock(job)
+
+	if job.Mode == ModeIncremental && schedule.FullInterval > 0 {
+		lastFull, err := s.backup.lastFullSync(ctx, job)
+		if err != nil {
+			logger.WithError(err).Error("failed to get last full sync time")
+		} else {
+			job.Mode = schedule.mode(lastFull, time.Now())
+		}
+	}
+
+	start := time.Now()
+	s.updateStatus(index, func(status *ScheduleStatus) {
+		status.Running = true
+		status.LastStart = &start
+		status.LastMode = job.Mode
+		status.NextRun = nil
+	})
+
+	logger.WithField("mode", job.Mode).Info("backup started")
+	err := s.backup.Run(ctx, job)
+	if err != nil {
+		logger.WithError(err).Error("backup failed")
+	} else {
+		logger.Info("backup finished")
+	}
+
+	end := time.Now()
+	s.updateStatus(index, func(status *ScheduleStatus) {
+		status.Running = false
+		status.LastEnd = &end
+		status.LastError = ""
+		if err != nil {
+			status.LastError = err.Error()
+		}
+	})
+}
+
+func (s *Scheduler) lock(job Job) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	key := job.String()
+	if s.running[key] {
+		return false
+	}
+	s.running[key] = true
+	return true
+}
+
+func (s *Scheduler) unlock(job Job) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.running, job.String())
+}
+
+func (s *Scheduler) updateStatus(index int, update func(status *ScheduleStatus)) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	update(&s.status[index])
+}
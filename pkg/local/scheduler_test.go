@@ -0,0 +1,148 @@
+package local
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rwlist/coub/pkg/conf"
+)
+
+func TestSchedules(t *testing.T) {
+	tests := []struct {
+		name      string
+		intervals []string
+		want      map[string]time.Duration
+		wantErr   bool
+	}{
+		{
+			name: "default interval",
+			want: map[string]time.Duration{"profile:a": time.Hour, "profile:b": time.Hour, "likes:me": time.Hour},
+		},
+		{
+			name:      "kind overrides default",
+			intervals: []string{"profile=6h"},
+			want:      map[string]time.Duration{"profile:a": 6 * time.Hour, "profile:b": 6 * time.Hour, "likes:me": time.Hour},
+		},
+		{
+			name:      "job overrides kind",
+			intervals: []string{"profile:b=24h", "profile=6h"},
+			want:      map[string]time.Duration{"profile:a": 6 * time.Hour, "profile:b": 24 * time.Hour, "likes:me": time.Hour},
+		},
+		{
+			name:      "zero runs once",
+			intervals: []string{"likes:me=0"},
+			want:      map[string]time.Duration{"profile:a": time.Hour, "profile:b": time.Hour, "likes:me": 0},
+		},
+		{
+			name:      "unknown jobs are ignored",
+			intervals: []string{"profile:c=2h", "favorites=3h"},
+			want:      map[string]time.Duration{"profile:a": time.Hour, "profile:b": time.Hour, "likes:me": time.Hour},
+		},
+		{name: "missing duration", intervals: []string{"profile"}, wantErr: true},
+		{name: "invalid duration", intervals: []string{"profile=daily"}, wantErr: true},
+		{name: "empty duration", intervals: []string{"profile="}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &conf.App{
+				CoubUsername:       "me",
+				BackupProfiles:     []string{"a", "b"},
+				BackupLikes:        true,
+				BackupMode:         string(ModeIncremental),
+				BackupInterval:     time.Hour,
+				BackupIntervals:    tt.intervals,
+				BackupFullInterval: 48 * time.Hour,
+			}
+
+			schedules, err := Schedules(cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %v", schedules)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := map[string]time.Duration{}
+			for _, schedule := range schedules {
+				got[schedule.Job.String()] = schedule.Interval
+				if schedule.Job.Mode != ModeIncremental || schedule.FullInterval != 48*time.Hour {
+					t.Errorf("%s: mode %s, full interval %v", schedule.Job, schedule.Job.Mode, schedule.FullInterval)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("intervals = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchedulesInvalidJobs(t *testing.T) {
+	tests := map[string]*conf.App{
+		"unknown mode":           {BackupMode: "fast"},
+		"likes without username": {BackupMode: string(ModeFull), BackupLikes: true},
+	}
+	for name, cfg := range tests {
+		if _, err := Schedules(cfg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestScheduleMode(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	incremental := Job{Kind: JobLikes, Target: "me", Mode: ModeIncremental}
+	full := Job{Kind: JobLikes, Target: "me", Mode: ModeFull}
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		lastFull time.Time
+		want     Mode
+	}{
+		{name: "never synced", schedule: Schedule{Job: incremental, FullInterval: 24 * time.Hour}, want: ModeFull},
+		{name: "synced recently", schedule: Schedule{Job: incremental, FullInterval: 24 * time.Hour}, lastFull: now.Add(-time.Hour), want: ModeIncremental},
+		{name: "synced long ago", schedule: Schedule{Job: incremental, FullInterval: 24 * time.Hour}, lastFull: now.Add(-25 * time.Hour), want: ModeFull},
+		{name: "full runs disabled", schedule: Schedule{Job: incremental}, want: ModeIncremental},
+		{name: "full job", schedule: Schedule{Job: full, FullInterval: 24 * time.Hour}, lastFull: now.Add(-time.Hour), want: ModeFull},
+	}
+
+	for _, tt := range tests {
+		if got := tt.schedule.mode(tt.lastFull, now); got != tt.want {
+			t.Errorf("%s: mode = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSchedulerLock(t *testing.T) {
+	likes := Job{Kind: JobLikes, Target: "me", Mode: ModeIncremental}
+	s := NewScheduler(nil, []Schedule{{Job: likes}})
+
+	if !s.lock(likes) {
+		t.Fatal("first lock failed")
+	}
+	if s.lock(likes) {
+		t.Error("the same job is locked twice")
+	}
+
+	// the same job with other schedule and mode shares the lock
+	fullLikes := likes
+	fullLikes.Mode = ModeFull
+	if s.lock(fullLikes) {
+		t.Error("the same job in full mode is locked while incremental one is running")
+	}
+
+	other := Job{Kind: JobProfile, Target: "me"}
+	if !s.lock(other) {
+		t.Error("other job can't be locked")
+	}
+
+	s.unlock(likes)
+	if !s.lock(fullLikes) {
+		t.Error("unlocked job can't be locked again")
+	}
+}
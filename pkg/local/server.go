@@ -1,40 +1,73 @@
-//nolint:dupl
 package local
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"io"
 	"math/rand"
 	"net/http"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/davecgh/go-spew/spew"
 	"github.com/go-chi/chi/v5"
 	"github.com/rwlist/coub/pkg/conf"
+	"github.com/rwlist/coub/pkg/coubs"
+	"github.com/rwlist/coub/pkg/storage"
+	log "github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
 type Server struct {
-	s3    *s3.S3
-	db    *gorm.DB
-	cfg   *conf.App
-	state *SharedState
+	storage    storage.Storage
+	db         *gorm.DB
+	cfg        *conf.App
+	tracker    *Tracker
+	downloader *Downloader
+	scheduler  *Scheduler
+	health     *Health
+
+	closing   chan struct{}
+	closeOnce sync.Once
 }
 
-func NewServer(sss *s3.S3, db *gorm.DB, cfg *conf.App, state *SharedState) *Server {
+func NewServer(
+	store storage.Storage,
+	db *gorm.DB,
+	cfg *conf.App,
+	tracker *Tracker,
+	downloader *Downloader,
+	scheduler *Scheduler,
+	health *Health,
+) *Server {
 	return &Server{
-		s3:    sss,
-		db:    db,
-		cfg:   cfg,
-		state: state,
+		storage:    store,
+		db:         db,
+		cfg:        cfg,
+		tracker:    tracker,
+		downloader: downloader,
+		scheduler:  scheduler,
+		health:     health,
+		closing:    make(chan struct{}),
 	}
 }
 
+// Close ends long-lived responses, such as event streams, which would
+// otherwise block http.Server.Shutdown.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+	})
+}
+
 func (s *Server) Router() *chi.Mux {
 	r := chi.NewRouter()
+	r.Get("/healthz", s.health.Healthz)
+	r.Get("/readyz", s.health.Readyz)
+
 	r.Get("/file/{filename}", s.handleFile)
 
 	r.Get("/profile", s.handleProfile)
@@ -45,87 +78,313 @@ func (s *Server) Router() *chi.Mux {
 	r.Get("/liked/{index:[0-9]+}", s.handleLiked)
 	r.Get("/liked{filter}/{index:[0-9]+}", s.handleLiked)
 
-	r.Get("/state", s.handleState)
+	r.Get("/favorites", s.handleFavorites)
+	r.Get("/favorites/{index:[0-9]+}", s.handleFavorites)
+	r.Get("/favorites_{filter}/{index:[0-9]+}", s.handleFavorites)
+
+	r.Get("/state", s.handleJobs)
+
+	r.Post("/archive/{permalink}", s.handleArchive)
+
+	r.Get("/api/jobs", s.handleJobs)
+	r.Get("/api/jobs/stream", s.handleJobsStream)
+	r.Get("/api/schedule", s.handleSchedule)
+	r.Get("/api/coubs/{kind}", s.handleListCoubs)
+	r.Get("/api/coubs/{id:[0-9]+}/stats", s.handleCoubStats)
 
 	return r
 }
 
-func (s *Server) handleState(w http.ResponseWriter, r *http.Request) {
-	state := s.state.Get()
-	spew.Fdump(w, state)
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.tracker.Jobs())
 }
 
-func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
-	filename := filepath.Base(r.URL.Path)
-	res, err := s.s3.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(s.cfg.S3Bucket),
-		Key:    &filename,
-	})
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+const (
+	// jobsStreamInterval limits how often progress is pushed to the client,
+	// downloads report transferred bytes far more often.
+	jobsStreamInterval  = time.Second
+	jobsStreamKeepAlive = 30 * time.Second
+)
+
+// handleJobsStream pushes the list of jobs as Server-Sent Events, once on
+// connect and then on every change.
+func (s *Server) handleJobsStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
 		return
 	}
 
-	if res.ContentType != nil {
-		w.Header().Set("Content-Type", *res.ContentType)
+	changed, unsubscribe := s.tracker.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ctx := r.Context()
+	timer := time.NewTimer(jobsStreamInterval)
+	defer timer.Stop()
+
+	for {
+		err := s.writeJobsEvent(w, flusher)
+		if err != nil {
+			return
+		}
+
+		// send at most one update per jobsStreamInterval
+		resetTimer(timer, jobsStreamInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		case <-s.closing:
+			return
+		}
+
+		resetTimer(timer, jobsStreamKeepAlive)
+	wait:
+		for {
+			select {
+			case <-changed:
+				break wait
+			case <-timer.C:
+				_, err = fmt.Fprint(w, ": keep-alive\n\n")
+				if err != nil {
+					return
+				}
+				flusher.Flush()
+				timer.Reset(jobsStreamKeepAlive)
+			case <-ctx.Done():
+				return
+			case <-s.closing:
+				return
+			}
+		}
 	}
-	if res.ContentLength != nil {
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", *res.ContentLength))
+}
+
+func (s *Server) writeJobsEvent(w http.ResponseWriter, flusher http.Flusher) error {
+	data, err := json.Marshal(s.tracker.Jobs())
+	if err != nil {
+		log.WithError(err).Error("failed to encode jobs")
+		return err
 	}
+	_, err = fmt.Fprintf(w, "event: jobs\ndata: %s\n\n", data)
+	if err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
 
-	_, _ = io.Copy(w, res.Body)
+// resetTimer restarts the timer, dropping a tick that was not received.
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
 }
 
-func (s *Server) handleProfile(w http.ResponseWriter, r *http.Request) {
-	filter := s.db.Model(&ProfileCoub{})
+func (s *Server) handleSchedule(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.scheduler.Status())
+}
 
-	filterParam := chi.URLParam(r, "filter")
-	if filterParam != "" {
-		filter = filter.Where("profile = ?", filterParam)
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+type listedCoub struct {
+	CoubID     int        `json:"coub_id"`
+	Profile    string     `json:"profile"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt *time.Time `json:"last_seen_at"`
+	RemovedAt  *time.Time `json:"removed_at"`
+}
+
+// handleListCoubs lists coubs of profiles, likes or favorites. Supported
+// query parameters are profile, removed (see filterRemoved), upstream
+// (see filterUpstream), limit and offset.
+func (s *Server) handleListCoubs(w http.ResponseWriter, r *http.Request) {
+	var model interface{}
+	switch chi.URLParam(r, "kind") {
+	case "profile":
+		model = &ProfileCoub{}
+	case "liked":
+		model = &LikedCoub{}
+	case "favorites":
+		model = &FavoriteCoub{}
+	default:
+		http.Error(w, "unknown kind", http.StatusNotFound)
+		return
 	}
 
-	var allCount int64
-	if err := filter.Count(&allCount).Error; err != nil {
+	query := r.URL.Query()
+	filter := s.db.WithContext(r.Context()).Model(model)
+	if profile := query.Get("profile"); profile != "" {
+		filter = filter.Where("profile = ?", profile)
+	}
+	filter, err := filterRemoved(filter, query.Get("removed"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err = filterUpstream(filter, query.Get("upstream"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultListLimit
+	if _, err := fmt.Sscanf(query.Get("limit"), "%d", &limit); err == nil && (limit < 1 || limit > maxListLimit) {
+		limit = maxListLimit
+	}
+	var offset int
+	_, _ = fmt.Sscanf(query.Get("offset"), "%d", &offset)
+
+	res := []listedCoub{}
+	err = filter.Order("id ASC").Limit(limit).Offset(offset).
+		Select("coub_id", "profile", "created_at", "last_seen_at", "removed_at").
+		Scan(&res).Error
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	numberRaw := chi.URLParam(r, "index")
-	var number int
-	if _, err := fmt.Sscanf(numberRaw, "%d", &number); err != nil {
-		// take a random coub
-		number = rand.Intn(int(allCount)) //nolint:gosec
+	writeJSON(w, res)
+}
+
+type coubStatsPoint struct {
+	Time         time.Time `json:"time"`
+	ViewsCount   int       `json:"views_count"`
+	LikesCount   int       `json:"likes_count"`
+	RecoubsCount int       `json:"recoubs_count"`
+	RemixesCount int       `json:"remixes_count"`
+}
+
+func (s *Server) handleCoubStats(w http.ResponseWriter, r *http.Request) {
+	var stats []CoubStats
+	err := s.db.WithContext(r.Context()).
+		Where("coub_id = ?", chi.URLParam(r, "id")).
+		Order("created_at ASC").
+		Find(&stats).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res := make([]coubStatsPoint, 0, len(stats))
+	for _, point := range stats {
+		res = append(res, coubStatsPoint{
+			Time:         point.CreatedAt,
+			ViewsCount:   point.ViewsCount,
+			LikesCount:   point.LikesCount,
+			RecoubsCount: point.RecoubsCount,
+			RemixesCount: point.RemixesCount,
+		})
 	}
+	writeJSON(w, res)
+}
 
-	var profileCoub ProfileCoub
-	err := filter.Order("published_at ASC").Limit(1).Offset(number).Find(&profileCoub).Error
+func (s *Server) handleArchive(w http.ResponseWriter, r *http.Request) {
+	permalink := chi.URLParam(r, "permalink")
+
+	err := s.downloader.DownloadPermalink(r.Context(), permalink)
+	if errors.Is(err, coubs.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	z0rViewer{
-		CoubID:     profileCoub.CoubID,
-		Number:     number,
-		AllCount:   int(allCount),
+	_, _ = fmt.Fprintf(w, "coub %s archived\n", permalink)
+}
+
+func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
+	filename := filepath.Base(r.URL.Path)
+	res, err := s.storage.Get(r.Context(), filename, r.Header.Get("Range"))
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, storage.ErrInvalidRange):
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer res.Body.Close()
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	if res.ContentType != "" {
+		w.Header().Set("Content-Type", res.ContentType)
+	}
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", res.ContentLength))
+	if res.ContentRange != "" {
+		w.Header().Set("Content-Range", res.ContentRange)
+		w.WriteHeader(http.StatusPartialContent)
+	}
+
+	_, _ = io.Copy(w, res.Body)
+}
+
+func (s *Server) handleProfile(w http.ResponseWriter, r *http.Request) {
+	s.renderCoubs(w, r, &ProfileCoub{}, "published_at ASC", z0rViewer{
 		DefaultURL: "profile",
 		Header:     "Profile",
-	}.Render(w, r)
+	})
 }
 
 func (s *Server) handleLiked(w http.ResponseWriter, r *http.Request) {
-	filter := s.db.Model(&LikedCoub{})
+	s.renderCoubs(w, r, &LikedCoub{}, "id ASC", z0rViewer{
+		DefaultURL: "liked",
+		Header:     "Liked",
+	})
+}
+
+func (s *Server) handleFavorites(w http.ResponseWriter, r *http.Request) {
+	s.renderCoubs(w, r, &FavoriteCoub{}, "id ASC", z0rViewer{
+		DefaultURL: "favorites",
+		Header:     "Favorites",
+	})
+}
+
+// renderCoubs shows a single coub from the table of model, which must have
+// profile and coub_id columns.
+func (s *Server) renderCoubs(w http.ResponseWriter, r *http.Request, model interface{}, order string, viewer z0rViewer) {
+	filter := s.db.Model(model)
 
 	filterParam := chi.URLParam(r, "filter")
 	if filterParam != "" {
 		filter = filter.Where("profile = ?", filterParam)
 	}
 
+	filter, err := filterRemoved(filter, r.URL.Query().Get("removed"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err = filterUpstream(filter, r.URL.Query().Get("upstream"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	var allCount int64
 	if err := filter.Count(&allCount).Error; err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if allCount == 0 {
+		http.Error(w, "no coubs found", http.StatusNotFound)
+		return
+	}
 
 	numberRaw := chi.URLParam(r, "index")
 	var number int
@@ -134,24 +393,30 @@ func (s *Server) handleLiked(w http.ResponseWriter, r *http.Request) {
 		number = rand.Intn(int(allCount)) //nolint:gosec
 	}
 
-	var likedCoub LikedCoub
-	err := filter.Order("id ASC").Limit(1).Offset(number).Find(&likedCoub).Error
+	var rows []struct {
+		CoubID    int
+		RemovedAt *time.Time
+	}
+	err = filter.Order(order).Limit(1).Offset(number).Select("coub_id", "removed_at").Scan(&rows).Error
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if len(rows) == 0 {
+		http.Error(w, "coub not found", http.StatusNotFound)
+		return
+	}
 
-	z0rViewer{
-		CoubID:     likedCoub.CoubID,
-		Number:     number,
-		AllCount:   int(allCount),
-		DefaultURL: "liked",
-		Header:     "Liked",
-	}.Render(w, r)
+	viewer.CoubID = rows[0].CoubID
+	viewer.RemovedAt = rows[0].RemovedAt
+	viewer.Number = number
+	viewer.AllCount = int(allCount)
+	viewer.Render(w, r)
 }
 
 type z0rViewer struct {
 	CoubID     int
+	RemovedAt  *time.Time
 	Number     int
 	AllCount   int
 	DefaultURL string
@@ -175,6 +440,15 @@ func (z z0rViewer) Render(w http.ResponseWriter, r *http.Request) {
 		urlFirstElem = cleanURL[0]
 	}
 
+	query := ""
+	if r.URL.RawQuery != "" {
+		query = html.EscapeString("?" + r.URL.RawQuery)
+	}
+	removed := ""
+	if z.RemovedAt != nil {
+		removed = "<p>Removed from the timeline on " + z.RemovedAt.Format("2006-01-02") + "</p>"
+	}
+
 	w.Header().Set("Content-Type", "text/html")
 	_, _ = fmt.Fprintf(w, `<!DOCTYPE html>
 <html>
@@ -210,10 +484,11 @@ function handleFirstPlay(event) {
 <video class="viewer__video" loop="loop" controls autoplay preload="auto" src="/file/%v_video.mp4" onplay="handleFirstPlay(event)"></video>
 <br/>
 <audio preload="auto" controls loop="loop" src="/file/%v_audio.mp3"></audio>
+%s
 <p>
-<a href="/%v/%v">Prev</a>
-<a href="/%v/%v">Random</a>
-<a href="/%v/%v">Next</a>
+<a href="/%v/%v%s">Prev</a>
+<a href="/%v/%v%s">Random</a>
+<a href="/%v/%v%s">Next</a>
 </p>
 </center>
 </body>
@@ -223,11 +498,60 @@ function handleFirstPlay(event) {
 		z.Number,
 		z.CoubID,
 		z.CoubID,
+		removed,
 		urlFirstElem,
 		prev,
+		query,
 		urlFirstElem,
 		random,
+		query,
 		urlFirstElem,
 		next,
+		query,
 	)
 }
+
+// filterRemoved applies "removed" query parameter, which is one of "show"
+// (default), "hide" or "only".
+func filterRemoved(filter *gorm.DB, param string) (*gorm.DB, error) {
+	switch param {
+	case "", "show":
+		return filter, nil
+	case "hide":
+		return filter.Where("removed_at IS NULL"), nil
+	case "only":
+		return filter.Where("removed_at IS NOT NULL"), nil
+	default:
+		return nil, fmt.Errorf("invalid removed filter %q", param)
+	}
+}
+
+// filterUpstream applies "upstream" query parameter, which is either "lost"
+// for coubs that are no longer available on Coub, or a single status.
+func filterUpstream(filter *gorm.DB, param string) (*gorm.DB, error) {
+	var statuses []string
+	switch param {
+	case "":
+		return filter, nil
+	case "lost":
+		statuses = lostUpstream
+	case UpstreamUnknown, UpstreamAlive, UpstreamDeleted, UpstreamPrivate, UpstreamBanned:
+		statuses = []string{param}
+	default:
+		return nil, fmt.Errorf("invalid upstream filter %q", param)
+	}
+
+	saved := filter.Session(&gorm.Session{NewDB: true}).
+		Model(&SavedCoub{}).
+		Select("coub_id").
+		Where("upstream_status IN ?", statuses)
+	return filter.Where("coub_id IN (?)", saved), nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
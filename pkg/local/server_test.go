@@ -0,0 +1,68 @@
+package local
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobsStream(t *testing.T) {
+	tracker := NewTracker(10)
+	s := &Server{tracker: tracker, closing: make(chan struct{})}
+	server := httptest.NewServer(http.HandlerFunc(s.handleJobsStream))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("content type %q", ct)
+	}
+	if resp.Header.Get("Connection") == "keep-alive" {
+		t.Error("hop-by-hop Connection header is set")
+	}
+
+	events := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		t.Helper()
+		var lines []string
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatalf("read event: %v", err)
+			}
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	if event := readEvent(); event != "event: jobs\ndata: []\n" {
+		t.Errorf("first event %q", event)
+	}
+
+	progress := tracker.Start(Job{Kind: JobLikes, Target: "me"})
+	progress.CoubDone()
+	if event := readEvent(); !strings.Contains(event, `"kind":"likes"`) || !strings.Contains(event, `"done":1`) {
+		t.Errorf("event after change %q", event)
+	}
+
+	// the stream ends on Close, even while it's throttled
+	started := time.Now()
+	progress.CoubDone()
+	s.Close()
+	if _, err := io.ReadAll(events); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed > jobsStreamInterval/2 {
+		t.Errorf("stream ended %v after Close", elapsed)
+	}
+}
@@ -0,0 +1,156 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rwlist/coub/pkg/coubs"
+	log "github.com/sirupsen/logrus"
+)
+
+// Upstream statuses of archived coubs, saved in SavedCoub.UpstreamStatus.
+const (
+	UpstreamUnknown = "unknown"
+	UpstreamAlive   = "alive"
+	UpstreamDeleted = "deleted"
+	UpstreamPrivate = "private"
+	UpstreamBanned  = "banned"
+)
+
+// lostUpstream are statuses of coubs that can't be watched on Coub anymore.
+var lostUpstream = []string{UpstreamDeleted, UpstreamPrivate, UpstreamBanned}
+
+const walkBatchSize = 100
+
+// Verify checks archived coubs against the API and records their upstream
+// status. Coubs checked less than b.verifyAge ago are skipped.
+func (b *Backup) Verify(ctx context.Context) error {
+	session := &sessionCheck{client: b.client}
+	return b.walkSaved(ctx, "upstream_checked_at", b.verifyAge, func(saved *SavedCoub) error {
+		status, _, err := b.checkUpstream(ctx, session, saved)
+		if err != nil {
+			return err
+		}
+		return b.saveUpstreamStatus(ctx, saved, status)
+	})
+}
+
+// walkSaved calls fn for saved coubs, which have the timestamp column older
+// than maxAge or not set, starting from the oldest. fn must update column.
+func (b *Backup) walkSaved(ctx context.Context, column string, maxAge time.Duration, fn func(saved *SavedCoub) error) error {
+	before := time.Now().Add(-maxAge)
+	progress := progressFrom(ctx)
+
+	for {
+		var saved []SavedCoub
+		err := b.db.WithContext(ctx).
+			Where(column+" IS NULL OR "+column+" < ?", before).
+			Order(column + " ASC NULLS FIRST").
+			Limit(walkBatchSize).
+			Find(&saved).Error
+		if err != nil {
+			return err
+		}
+		if len(saved) == 0 {
+			return nil
+		}
+
+		for i := range saved {
+			err = fn(&saved[i])
+			if err != nil {
+				return err
+			}
+			progress.CoubDone()
+		}
+	}
+}
+
+// sessionCheckAge is how long a successful session check is trusted during
+// a long verification.
+const sessionCheckAge = 10 * time.Minute
+
+// sessionCheck tells if the session works, checking it at most once per
+// sessionCheckAge. A failed check is repeated next time.
+type sessionCheck struct {
+	client    *coubs.Client
+	checkedAt time.Time
+}
+
+func (s *sessionCheck) check(ctx context.Context) error {
+	if !s.checkedAt.IsZero() && time.Since(s.checkedAt) < sessionCheckAge {
+		return nil
+	}
+
+	_, err := s.client.Likes(ctx, 1)
+	if err != nil {
+		s.checkedAt = time.Time{}
+		return err
+	}
+	s.checkedAt = time.Now()
+	return nil
+}
+
+// checkUpstream fetches the coub from the API. Returns its current metadata
+// if the coub is alive. Errors that are not related to the coub itself
+// are returned, so that the job stops instead of marking all coubs lost.
+func (b *Backup) checkUpstream(ctx context.Context, session *sessionCheck, saved *SavedCoub) (string, json.RawMessage, error) {
+	var coub coubs.Coub
+	_ = json.Unmarshal(saved.Info, &coub)
+	permalink := coub.Permalink
+	if permalink == "" {
+		permalink = strconv.Itoa(saved.CoubID)
+	}
+
+	rawCoub, err := b.client.Coub(ctx, permalink)
+	if err == nil {
+		return UpstreamAlive, rawCoub, nil
+	}
+
+	var apiErr *coubs.APIError
+	if !errors.As(err, &apiErr) {
+		return "", nil, err
+	}
+	if errors.Is(err, coubs.ErrSessionExpired) {
+		// 403 is returned both for private coubs and for an expired session,
+		// the coub is private only if the session still works
+		if apiErr.StatusCode != http.StatusForbidden {
+			return "", nil, err
+		}
+		if sessionErr := session.check(ctx); sessionErr != nil {
+			return "", nil, fmt.Errorf("check session after 403 for coub %d: %w", saved.CoubID, sessionErr)
+		}
+		return UpstreamPrivate, nil, nil
+	}
+
+	switch apiErr.StatusCode {
+	case http.StatusNotFound:
+		return UpstreamDeleted, nil, nil
+	case http.StatusGone, http.StatusUnavailableForLegalReasons:
+		return UpstreamBanned, nil, nil
+	default:
+		return "", nil, err
+	}
+}
+
+func (b *Backup) saveUpstreamStatus(ctx context.Context, saved *SavedCoub, status string) error {
+	now := time.Now()
+	updates := map[string]interface{}{
+		"upstream_status":     status,
+		"upstream_checked_at": now,
+	}
+	if status != saved.UpstreamStatus {
+		updates["upstream_changed_at"] = now
+
+		log.WithField("coub_id", saved.CoubID).
+			WithField("from", saved.UpstreamStatus).
+			WithField("to", status).
+			Info("Upstream status of coub changed")
+	}
+
+	return b.db.WithContext(ctx).Model(&SavedCoub{}).Where("coub_id = ?", saved.CoubID).Updates(updates).Error
+}
@@ -0,0 +1,136 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rwlist/coub/pkg/coubs"
+)
+
+// upstream is a fake Coub API, which responds to /coubs/<status> with that
+// status and counts session checks.
+type upstream struct {
+	mux           sync.Mutex
+	likesStatus   int
+	sessionChecks int
+}
+
+func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.URL.Path == "/timeline/likes" {
+		u.mux.Lock()
+		u.sessionChecks++
+		status := u.likesStatus
+		u.mux.Unlock()
+
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"page":1,"total_pages":1,"coubs":[]}`))
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, "/coubs/") {
+	case "alive":
+		_, _ = w.Write([]byte(`{"id":1,"permalink":"alive"}`))
+	case "deleted":
+		w.WriteHeader(http.StatusNotFound)
+	case "banned":
+		w.WriteHeader(http.StatusUnavailableForLegalReasons)
+	case "private":
+		w.WriteHeader(http.StatusForbidden)
+	case "unauthorized":
+		w.WriteHeader(http.StatusUnauthorized)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (u *upstream) checks() int {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	return u.sessionChecks
+}
+
+func newUpstreamBackup(t *testing.T, likesStatus int) (*Backup, *upstream) {
+	t.Helper()
+
+	u := &upstream{likesStatus: likesStatus}
+	server := httptest.NewServer(u)
+	t.Cleanup(server.Close)
+
+	client := coubs.NewClient(staticSession{}, coubs.WithBaseURL(server.URL))
+	return &Backup{client: client}, u
+}
+
+func savedCoub(permalink string) *SavedCoub {
+	return &SavedCoub{CoubID: 1, Info: []byte(`{"id":1,"permalink":"` + permalink + `"}`)}
+}
+
+func TestCheckUpstream(t *testing.T) {
+	tests := []struct {
+		permalink   string
+		likesStatus int
+		wantStatus  string
+		wantErr     bool
+		wantExpired bool
+	}{
+		{permalink: "alive", likesStatus: http.StatusOK, wantStatus: UpstreamAlive},
+		{permalink: "deleted", likesStatus: http.StatusOK, wantStatus: UpstreamDeleted},
+		{permalink: "banned", likesStatus: http.StatusOK, wantStatus: UpstreamBanned},
+		{permalink: "private", likesStatus: http.StatusOK, wantStatus: UpstreamPrivate},
+		{permalink: "private", likesStatus: http.StatusForbidden, wantErr: true, wantExpired: true},
+		{permalink: "unauthorized", likesStatus: http.StatusOK, wantErr: true, wantExpired: true},
+		{permalink: "broken", likesStatus: http.StatusOK, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		b, _ := newUpstreamBackup(t, tt.likesStatus)
+		session := &sessionCheck{client: b.client}
+
+		status, _, err := b.checkUpstream(context.Background(), session, savedCoub(tt.permalink))
+		if tt.wantErr {
+			if err == nil || errors.Is(err, coubs.ErrSessionExpired) != tt.wantExpired {
+				t.Errorf("%s with likes %d: err = %v, status %q", tt.permalink, tt.likesStatus, err, status)
+			}
+			continue
+		}
+		if err != nil || status != tt.wantStatus {
+			t.Errorf("%s: status = %q, err = %v, want %q", tt.permalink, status, err, tt.wantStatus)
+		}
+	}
+}
+
+func TestCheckUpstreamSessionCached(t *testing.T) {
+	ctx := context.Background()
+	b, u := newUpstreamBackup(t, http.StatusForbidden)
+	session := &sessionCheck{client: b.client}
+
+	// failed checks are repeated
+	for i := 0; i < 2; i++ {
+		if _, _, err := b.checkUpstream(ctx, session, savedCoub("private")); err == nil {
+			t.Fatal("private coub with expired session must fail")
+		}
+	}
+	if checks := u.checks(); checks != 2 {
+		t.Errorf("%d session checks after failures, want 2", checks)
+	}
+
+	u.mux.Lock()
+	u.likesStatus = http.StatusOK
+	u.mux.Unlock()
+
+	for i := 0; i < 5; i++ {
+		status, _, err := b.checkUpstream(ctx, session, savedCoub("private"))
+		if err != nil || status != UpstreamPrivate {
+			t.Fatalf("status = %q, err = %v", status, err)
+		}
+	}
+	if checks := u.checks(); checks != 3 {
+		t.Errorf("%d session checks, want 3", checks)
+	}
+}
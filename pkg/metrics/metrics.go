@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rwlist/coub/pkg/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// Results of processed coubs, used as the "result" label of Coubs.
+const (
+	ResultArchived = "archived"
+	ResultSkipped  = "skipped"
+	ResultFailed   = "failed"
+)
+
+var (
+	APIRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "coub_api_requests_total",
+		Help: "Requests to Coub API by endpoint and HTTP status, status is \"error\" if no response was received.",
+	}, []string{"endpoint", "status"})
+
+	Coubs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "coub_backup_coubs_total",
+		Help: "Coubs processed by backups by job kind, profile and result.",
+	}, []string{"kind", "profile", "result"})
+
+	UploadedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "coub_uploaded_bytes_total",
+		Help: "Bytes of media uploaded to the storage.",
+	})
+
+	DownloadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "coub_download_duration_seconds",
+		Help:    "Time until response headers of media downloads from Coub.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"media"})
+
+	UploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "coub_upload_duration_seconds",
+		Help:    "Time of streaming downloaded media to the storage.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"media"})
+
+	StorageObjects = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "coub_storage_objects",
+		Help: "Number of objects in the storage, updated periodically.",
+	})
+)
+
+// SessionAge registers the gauge with seconds since the session cookies
+// were refreshed by the API. It's NaN until the first refresh.
+func SessionAge(lastRefreshed func() (time.Time, error)) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "coub_session_age_seconds",
+		Help: "Seconds since the session cookies were last refreshed by Coub API.",
+	}, func() float64 {
+		refreshed, err := lastRefreshed()
+		if err != nil {
+			log.WithError(err).Warn("failed to get session refresh time")
+			return math.NaN()
+		}
+		if refreshed.IsZero() {
+			return math.NaN()
+		}
+		return time.Since(refreshed).Seconds()
+	})
+}
+
+// CountObjectsLoop updates StorageObjects every interval until ctx is done.
+// Listing a large bucket is slow, so it's not done on every scrape.
+func CountObjectsLoop(ctx context.Context, store storage.Storage, interval time.Duration) {
+	for {
+		count := 0
+		err := store.List(ctx, "", func(info storage.ObjectInfo) error {
+			count++
+			return nil
+		})
+		if err != nil {
+			log.WithError(err).Warn("failed to count storage objects")
+		} else {
+			StorageObjects.Set(float64(count))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
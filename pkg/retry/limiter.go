@@ -0,0 +1,40 @@
+package retry
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter spaces calls to Wait evenly, allowing at most perSecond calls per second.
+type Limiter struct {
+	mux      sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// NewLimiter creates a limiter, zero or negative rate disables limiting.
+func NewLimiter(perSecond float64) *Limiter {
+	l := &Limiter{}
+	if perSecond > 0 {
+		l.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+	return l
+}
+
+func (l *Limiter) Wait(ctx context.Context) error {
+	if l == nil || l.interval == 0 {
+		return ctx.Err()
+	}
+
+	l.mux.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mux.Unlock()
+
+	return Sleep(ctx, wait)
+}
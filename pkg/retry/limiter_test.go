@@ -0,0 +1,53 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter(100)
+	ctx := context.Background()
+
+	started := time.Now()
+	for i := 0; i < 6; i++ {
+		if err := limiter.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first call doesn't wait, the rest are 10ms apart
+	if elapsed := time.Since(started); elapsed < 50*time.Millisecond {
+		t.Errorf("6 calls took %v, want at least 50ms", elapsed)
+	}
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	var nilLimiter *Limiter
+	for _, limiter := range []*Limiter{NewLimiter(0), NewLimiter(-1), nilLimiter} {
+		started := time.Now()
+		for i := 0; i < 100; i++ {
+			if err := limiter.Wait(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if elapsed := time.Since(started); elapsed > 10*time.Millisecond {
+			t.Errorf("disabled limiter waited %v", elapsed)
+		}
+	}
+}
+
+func TestLimiterCancelled(t *testing.T) {
+	limiter := NewLimiter(0.001)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := limiter.Wait(ctx); err != nil {
+		t.Fatalf("first call must not wait, got %v", err)
+	}
+	if err := limiter.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want deadline exceeded", err)
+	}
+}
@@ -0,0 +1,141 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Policy describes bounded retries with exponential backoff and jitter.
+// Zero value makes a single attempt.
+type Policy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+type permanentError struct {
+	err error
+}
+
+// Permanent marks an error that must not be retried.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+type delayedError struct {
+	err   error
+	delay time.Duration
+}
+
+// After returns an error that asks to wait at least delay before the next attempt.
+func After(err error, delay time.Duration) error {
+	return &delayedError{err: err, delay: delay}
+}
+
+func (e *delayedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *delayedError) Unwrap() error {
+	return e.err
+}
+
+func (e *delayedError) RetryAfter() time.Duration {
+	return e.delay
+}
+
+// Do calls fn until it succeeds, returns a permanent error, attempts run out
+// or ctx is done. An error asking to wait longer than MaxDelay is returned
+// right away, so that the caller can wait for RetryAfter itself.
+func (p Policy) Do(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		var perm *permanentError
+		if errors.As(err, &perm) {
+			return perm.err
+		}
+		if attempt >= p.MaxAttempts {
+			return err
+		}
+
+		delay := p.Delay(attempt, err)
+		if p.MaxDelay > 0 && delay > p.MaxDelay {
+			return err
+		}
+		log.WithError(err).WithField("attempt", attempt).WithField("delay", delay.String()).Warn("Retrying after error")
+		if sleepErr := Sleep(ctx, delay); sleepErr != nil {
+			return err
+		}
+	}
+}
+
+// Sleep pauses for d, returning early with ctx error if ctx is done.
+func Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Delay returns how long to wait after the given failed attempt. Errors
+// carrying Retry-After take precedence over the backoff and are never cut
+// down, the backoff is capped by MaxDelay.
+func (p Policy) Delay(attempt int, err error) time.Duration {
+	var hinted interface{ RetryAfter() time.Duration }
+	if errors.As(err, &hinted) && hinted.RetryAfter() > 0 {
+		return hinted.RetryAfter()
+	}
+
+	backoff := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || backoff < p.MaxDelay); i++ {
+		backoff *= 2
+	}
+	if p.MaxDelay > 0 && backoff > p.MaxDelay {
+		backoff = p.MaxDelay
+	}
+	if backoff <= 0 {
+		return 0
+	}
+
+	// wait at least half of the backoff, the rest is random
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(backoff-half)+1)) //nolint:gosec
+}
+
+// ParseRetryAfter parses Retry-After header, which is either a number of
+// seconds or an HTTP date. Returns 0 if the header is missing or invalid.
+func ParseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
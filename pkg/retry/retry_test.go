@@ -0,0 +1,120 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var errTest = errors.New("test error")
+
+func TestDelay(t *testing.T) {
+	policy := Policy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+
+	tests := []struct {
+		name    string
+		policy  Policy
+		attempt int
+		err     error
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		{name: "first attempt", policy: policy, attempt: 1, err: errTest, wantMin: 500 * time.Millisecond, wantMax: time.Second},
+		{name: "backoff doubles", policy: policy, attempt: 3, err: errTest, wantMin: 2 * time.Second, wantMax: 4 * time.Second},
+		{name: "backoff is capped", policy: policy, attempt: 10, err: errTest, wantMin: 2500 * time.Millisecond, wantMax: 5 * time.Second},
+		{name: "retry after", policy: policy, attempt: 1, err: After(errTest, 3*time.Second), wantMin: 3 * time.Second, wantMax: 3 * time.Second},
+		{name: "long retry after", policy: policy, attempt: 1, err: After(errTest, time.Hour), wantMin: time.Hour, wantMax: time.Hour},
+		{name: "zero retry after", policy: policy, attempt: 1, err: After(errTest, 0), wantMin: 500 * time.Millisecond, wantMax: time.Second},
+		{name: "no max delay", policy: Policy{BaseDelay: time.Second}, attempt: 11, err: errTest, wantMin: 512 * time.Second, wantMax: 1024 * time.Second},
+		{name: "zero policy", attempt: 1, err: errTest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				delay := tt.policy.Delay(tt.attempt, tt.err)
+				if delay < tt.wantMin || delay > tt.wantMax {
+					t.Fatalf("delay %v, want between %v and %v", delay, tt.wantMin, tt.wantMax)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":          0,
+		"0":         0,
+		"120":       2 * time.Minute,
+		"soon":      0,
+		"1.5":       0,
+		"Mon, 32 X": 0,
+	}
+	for header, want := range tests {
+		if got := ParseRetryAfter(header); got != want {
+			t.Errorf("ParseRetryAfter(%q) = %v, want %v", header, got, want)
+		}
+	}
+
+	at := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	got := ParseRetryAfter(at)
+	if got < 59*time.Minute || got > time.Hour {
+		t.Errorf("ParseRetryAfter(%q) = %v, want about an hour", at, got)
+	}
+}
+
+func TestDo(t *testing.T) {
+	policy := Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+	tests := []struct {
+		name      string
+		policy    Policy
+		errs      []error
+		wantErr   error
+		wantCalls int
+	}{
+		{name: "success", policy: policy, wantCalls: 1},
+		{name: "retried", policy: policy, errs: []error{errTest, errTest}, wantCalls: 3},
+		{name: "attempts run out", policy: policy, errs: []error{errTest, errTest, errTest}, wantErr: errTest, wantCalls: 3},
+		{name: "permanent", policy: policy, errs: []error{Permanent(errTest)}, wantErr: errTest, wantCalls: 1},
+		{name: "short retry after", policy: policy, errs: []error{After(errTest, time.Millisecond)}, wantCalls: 2},
+		{name: "long retry after", policy: policy, errs: []error{After(errTest, time.Hour)}, wantErr: errTest, wantCalls: 1},
+		{name: "zero policy", errs: []error{errTest}, wantErr: errTest, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := tt.policy.Do(context.Background(), func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("%d calls, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestDoCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := Policy{MaxAttempts: 3, BaseDelay: time.Hour, MaxDelay: time.Hour}
+
+	calls := 0
+	err := policy.Do(ctx, func() error {
+		calls++
+		cancel()
+		return errTest
+	})
+	if !errors.Is(err, errTest) || calls != 1 {
+		t.Errorf("err = %v after %d calls, want %v after 1 call", err, calls, errTest)
+	}
+}
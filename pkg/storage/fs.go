@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const tempPrefix = ".tmp-"
+
+// FS keeps objects as plain files in a local directory.
+type FS struct {
+	dir string
+}
+
+func NewFS(dir string) (*FS, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &FS{dir: dir}, nil
+}
+
+func (s *FS) path(key string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(key))
+	if key == "" || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(s.dir, clean), nil
+}
+
+func (s *FS) Put(ctx context.Context, key string, body io.Reader, size int64, _ string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so that readers never see partial objects
+	tmp, err := os.CreateTemp(filepath.Dir(path), tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, &contextReader{ctx: ctx, r: body})
+	if err == nil && size >= 0 && written != size {
+		err = fmt.Errorf("%w: read %d bytes, expected %d", io.ErrUnexpectedEOF, written, size)
+	}
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *FS) Get(_ context.Context, key, byteRange string) (*Object, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, convertFSError(err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	obj := &Object{
+		ObjectInfo:    fileInfo(key, stat),
+		Body:          file,
+		ContentLength: stat.Size(),
+	}
+	if byteRange == "" {
+		return obj, nil
+	}
+
+	start, length, err := parseRange(byteRange, stat.Size())
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	_, err = file.Seek(start, io.SeekStart)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	obj.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}
+	obj.ContentLength = length
+	obj.ContentRange = fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, stat.Size())
+	return obj, nil
+}
+
+func (s *FS) Stat(_ context.Context, key string) (*ObjectInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, convertFSError(err)
+	}
+
+	info := fileInfo(key, stat)
+	return &info, nil
+}
+
+func (s *FS) Delete(_ context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FS) List(ctx context.Context, prefix string, fn func(info ObjectInfo) error) error {
+	return filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), tempPrefix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		stat, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return fn(fileInfo(key, stat))
+	})
+}
+
+func (s *FS) Check(ctx context.Context) error {
+	stat, err := os.Stat(s.dir)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("%s is not a directory", s.dir)
+	}
+	return nil
+}
+
+func fileInfo(key string, stat fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:         key,
+		Size:        stat.Size(),
+		ContentType: mime.TypeByExtension(filepath.Ext(key)),
+		ModTime:     stat.ModTime(),
+	}
+}
+
+func convertFSError(err error) error {
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// parseRange parses a single range in "bytes=start-end", "bytes=start-"
+// or "bytes=-suffix" form.
+func parseRange(header string, size int64) (start, length int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, ErrInvalidRange
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, ErrInvalidRange
+	}
+
+	if first == "" {
+		// a suffix of an empty object is unsatisfiable
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix <= 0 || size == 0 {
+			return 0, 0, ErrInvalidRange
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, suffix, nil
+	}
+
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, ErrInvalidRange
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, ErrInvalidRange
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, nil
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header     string
+		size       int64
+		wantStart  int64
+		wantLength int64
+		wantErr    bool
+	}{
+		{header: "bytes=0-99", size: 1000, wantStart: 0, wantLength: 100},
+		{header: "bytes=100-", size: 1000, wantStart: 100, wantLength: 900},
+		{header: "bytes=999-999", size: 1000, wantStart: 999, wantLength: 1},
+		{header: "bytes=900-2000", size: 1000, wantStart: 900, wantLength: 100},
+		{header: "bytes= 0-9", size: 1000, wantStart: 0, wantLength: 10},
+
+		// suffix ranges
+		{header: "bytes=-100", size: 1000, wantStart: 900, wantLength: 100},
+		{header: "bytes=-5000", size: 1000, wantStart: 0, wantLength: 1000},
+		{header: "bytes=-0", size: 1000, wantErr: true},
+		{header: "bytes=-1", size: 0, wantErr: true},
+
+		// start past the end
+		{header: "bytes=1000-", size: 1000, wantErr: true},
+		{header: "bytes=1000-1100", size: 1000, wantErr: true},
+		{header: "bytes=0-", size: 0, wantErr: true},
+
+		// multiple ranges are not supported
+		{header: "bytes=0-9,20-29", size: 1000, wantErr: true},
+		{header: "bytes=0-9, -10", size: 1000, wantErr: true},
+
+		// malformed
+		{header: "", size: 1000, wantErr: true},
+		{header: "items=0-9", size: 1000, wantErr: true},
+		{header: "bytes=9-0", size: 1000, wantErr: true},
+		{header: "bytes=-", size: 1000, wantErr: true},
+		{header: "bytes=a-9", size: 1000, wantErr: true},
+		{header: "bytes=0-b", size: 1000, wantErr: true},
+		{header: "bytes=-1-9", size: 1000, wantErr: true},
+		{header: "bytes=10", size: 1000, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		start, length, err := parseRange(tt.header, tt.size)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidRange) {
+				t.Errorf("parseRange(%q, %d) = %d, %d, %v, want ErrInvalidRange", tt.header, tt.size, start, length, err)
+			}
+			continue
+		}
+		if err != nil || start != tt.wantStart || length != tt.wantLength {
+			t.Errorf("parseRange(%q, %d) = %d, %d, %v, want %d, %d",
+				tt.header, tt.size, start, length, err, tt.wantStart, tt.wantLength)
+		}
+	}
+}
+
+func TestFSRange(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := "0123456789"
+	err = store.Put(ctx, "1_video.mp4", strings.NewReader(data), int64(len(data)), "video/mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		byteRange        string
+		wantBody         string
+		wantContentRange string
+	}{
+		{byteRange: "", wantBody: data},
+		{byteRange: "bytes=2-4", wantBody: "234", wantContentRange: "bytes 2-4/10"},
+		{byteRange: "bytes=-3", wantBody: "789", wantContentRange: "bytes 7-9/10"},
+		{byteRange: "bytes=8-", wantBody: "89", wantContentRange: "bytes 8-9/10"},
+	}
+	for _, tt := range tests {
+		obj, err := store.Get(ctx, "1_video.mp4", tt.byteRange)
+		if err != nil {
+			t.Fatalf("Get(%q): %v", tt.byteRange, err)
+		}
+		body, err := io.ReadAll(obj.Body)
+		_ = obj.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(body) != tt.wantBody || obj.ContentLength != int64(len(tt.wantBody)) {
+			t.Errorf("Get(%q) body = %q, length %d, want %q", tt.byteRange, body, obj.ContentLength, tt.wantBody)
+		}
+		if obj.ContentRange != tt.wantContentRange {
+			t.Errorf("Get(%q) content range = %q, want %q", tt.byteRange, obj.ContentRange, tt.wantContentRange)
+		}
+		if obj.Size != int64(len(data)) {
+			t.Errorf("Get(%q) size = %d", tt.byteRange, obj.Size)
+		}
+	}
+
+	_, err = store.Get(ctx, "1_video.mp4", "bytes=10-")
+	if !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("unsatisfiable range: err = %v", err)
+	}
+	_, err = store.Get(ctx, "2_video.mp4", "")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing object: err = %v", err)
+	}
+}
+
+func TestFSPutLength(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Put(ctx, "1_audio.mp3", strings.NewReader("short"), 10, "")
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated body: err = %v", err)
+	}
+	if _, err := store.Stat(ctx, "1_audio.mp3"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("truncated object must not be saved, stat err = %v", err)
+	}
+
+	err = store.Put(ctx, "1_audio.mp3", strings.NewReader("unknown"), -1, "")
+	if err != nil {
+		t.Errorf("unknown length: err = %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/rwlist/coub/pkg/conf"
+)
+
+type S3 struct {
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	partSize int64
+	bucket   string
+}
+
+func NewS3(cfg *conf.App) (*S3, error) {
+	// S3 rejects multipart uploads with smaller parts
+	if cfg.UploadPartSize < s3manager.MinUploadPartSize {
+		return nil, fmt.Errorf("UPLOAD_PART_SIZE must be at least %d bytes, got %d", s3manager.MinUploadPartSize, cfg.UploadPartSize)
+	}
+
+	// Configure to use MinIO Server
+	s3Config := &aws.Config{
+		Credentials:      credentials.NewStaticCredentials(cfg.S3AccessKey, cfg.S3SecretKey, ""),
+		Endpoint:         aws.String(cfg.S3Endpoint),
+		Region:           aws.String(cfg.S3Region),
+		DisableSSL:       aws.Bool(false),
+		S3ForcePathStyle: aws.Bool(true),
+	}
+	newSession, err := session.NewSession(s3Config)
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.New(newSession)
+	return &S3{
+		client: client,
+		// uploader buffers at most Concurrency parts of PartSize, it's used
+		// for objects of unknown size or larger than a part
+		uploader: s3manager.NewUploaderWithClient(client, func(u *s3manager.Uploader) {
+			u.PartSize = cfg.UploadPartSize
+			u.Concurrency = cfg.UploadConcurrency
+			u.LeavePartsOnError = false
+		}),
+		partSize: cfg.UploadPartSize,
+		bucket:   cfg.S3Bucket,
+	}, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	if size >= 0 && size < s.partSize {
+		return s.putObject(ctx, key, body, size, contentType)
+	}
+
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+
+	_, err := s.uploader.UploadWithContext(ctx, input, func(u *s3manager.Uploader) {
+		// large objects of known size must fit into the limit of parts
+		if minPartSize := size/s3manager.MaxUploadParts + 1; size > 0 && minPartSize > u.PartSize {
+			u.PartSize = minPartSize
+		}
+	})
+	return err
+}
+
+// putObject sends a small object of known size with a single request.
+func (s *S3) putObject(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	// read one byte more to detect a body longer than size
+	data, err := io.ReadAll(io.LimitReader(body, size+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return fmt.Errorf("%w: read %d bytes, expected %d", io.ErrUnexpectedEOF, len(data), size)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(size),
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+
+	_, err = s.client.PutObjectWithContext(ctx, input)
+	return err
+}
+
+func (s *S3) Get(ctx context.Context, key, byteRange string) (*Object, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if byteRange != "" {
+		input.Range = aws.String(byteRange)
+	}
+
+	res, err := s.client.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	obj := &Object{
+		ObjectInfo: ObjectInfo{
+			Key:         key,
+			Size:        aws.Int64Value(res.ContentLength),
+			ContentType: aws.StringValue(res.ContentType),
+			ModTime:     aws.TimeValue(res.LastModified),
+		},
+		Body:          res.Body,
+		ContentLength: aws.Int64Value(res.ContentLength),
+		ContentRange:  aws.StringValue(res.ContentRange),
+	}
+	if obj.ContentRange != "" {
+		// "bytes 0-99/1000"
+		_, total, _ := strings.Cut(obj.ContentRange, "/")
+		obj.Size, _ = strconv.ParseInt(total, 10, 64)
+	}
+	return obj, nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	res, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	return &ObjectInfo{
+		Key:         key,
+		Size:        aws.Int64Value(res.ContentLength),
+		ContentType: aws.StringValue(res.ContentType),
+		ModTime:     aws.TimeValue(res.LastModified),
+	}, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return convertError(err)
+}
+
+func (s *S3) List(ctx context.Context, prefix string, fn func(info ObjectInfo) error) error {
+	var fnErr error
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range page.Contents {
+			fnErr = fn(ObjectInfo{
+				Key:     aws.StringValue(item.Key),
+				Size:    aws.Int64Value(item.Size),
+				ModTime: aws.TimeValue(item.LastModified),
+			})
+			if fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+func (s *S3) Check(ctx context.Context) error {
+	_, err := s.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s.bucket),
+	})
+	return err
+}
+
+func convertError(err error) error {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return err
+	}
+
+	switch awsErr.Code() {
+	case s3.ErrCodeNoSuchKey, "NotFound":
+		return ErrNotFound
+	case "InvalidRange":
+		return ErrInvalidRange
+	default:
+		return err
+	}
+}
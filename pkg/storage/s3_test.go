@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/rwlist/coub/pkg/conf"
+)
+
+func TestNewS3PartSize(t *testing.T) {
+	tests := map[int64]bool{
+		0:                false,
+		1024 * 1024:      false,
+		5*1024*1024 - 1:  false,
+		5 * 1024 * 1024:  true,
+		64 * 1024 * 1024: true,
+	}
+	for partSize, wantOK := range tests {
+		_, err := NewS3(&conf.App{S3Region: "us-east-1", S3Bucket: "coubs", UploadPartSize: partSize})
+		if (err == nil) != wantOK {
+			t.Errorf("part size %d: err = %v", partSize, err)
+		}
+	}
+}
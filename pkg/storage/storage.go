@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rwlist/coub/pkg/conf"
+)
+
+var (
+	ErrNotFound     = errors.New("object not found")
+	ErrInvalidRange = errors.New("invalid range")
+)
+
+type ObjectInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+type Object struct {
+	ObjectInfo
+	Body io.ReadCloser
+	// ContentLength is the length of Body, it's less than Size for ranged reads.
+	ContentLength int64
+	// ContentRange is set for ranged reads, e.g. "bytes 0-99/1000".
+	ContentRange string
+}
+
+// Storage keeps media files of archived coubs.
+type Storage interface {
+	// Put saves the object, it's never visible partially written. size is
+	// the length of body, or -1 if it's unknown.
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	// Get reads the object. byteRange is a value of HTTP Range header with
+	// a single range, empty string reads the whole object.
+	Get(ctx context.Context, key, byteRange string) (*Object, error)
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	// List calls fn for every object with the given prefix.
+	List(ctx context.Context, prefix string, fn func(info ObjectInfo) error) error
+	// Check returns an error if the storage is not accessible.
+	Check(ctx context.Context) error
+}
+
+func New(cfg *conf.App) (Storage, error) {
+	switch cfg.StorageBackend {
+	case "s3":
+		return NewS3(cfg)
+	case "fs":
+		return NewFS(cfg.StorageDir)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+}